@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds everything that differs between deployments.
+//
+// Values are resolved in increasing order of precedence: built-in defaults,
+// the config file (-config or MANGO_CONFIG, YAML or JSON), MANGO_*
+// environment variables and finally command-line flags.
+type Config struct {
+	Listen string      `json:"listen" yaml:"listen"`
+	Store  string      `json:"store" yaml:"store"`
+	Mongo  MongoConfig `json:"mongo" yaml:"mongo"`
+	Uber   UberConfig  `json:"uber" yaml:"uber"`
+	// Estimator selects the price source: uber or offline.
+	Estimator string        `json:"estimator" yaml:"estimator"`
+	Offline   OfflineConfig `json:"offline" yaml:"offline"`
+	Planner   PlannerConfig `json:"planner" yaml:"planner"`
+	Cache     CacheConfig   `json:"cache" yaml:"cache"`
+	// Upstream controls the calls to Uber and Google.
+	Upstream UpstreamConfig `json:"upstream" yaml:"upstream"`
+	// Geocoder selects the address lookup: google or gazetteer. GeocoderURL
+	// is the root of the Google API, and Gazetteer the CSV or JSON file
+	// used by the gazetteer geocoder.
+	Geocoder    string `json:"geocoder" yaml:"geocoder"`
+	GeocoderURL string `json:"geocoder_url" yaml:"geocoder_url"`
+	Gazetteer   string `json:"gazetteer" yaml:"gazetteer"`
+}
+
+// MongoConfig describes the MongoDB connection and its session pool.
+type MongoConfig struct {
+	Hosts    []string `json:"hosts" yaml:"hosts"`
+	Database string   `json:"database" yaml:"database"`
+	Username string   `json:"username" yaml:"username"`
+	Password string   `json:"password" yaml:"password"`
+	// PoolLimit caps the number of sockets per server. Zero keeps the
+	// driver default of 4096.
+	PoolLimit int `json:"pool_limit" yaml:"pool_limit"`
+	// SyncTimeout is how long an operation waits for a usable server,
+	// including while the driver reconnects after a dropped connection.
+	SyncTimeout Duration `json:"sync_timeout" yaml:"sync_timeout"`
+	// SocketTimeout bounds each individual read or write on a socket.
+	SocketTimeout Duration `json:"socket_timeout" yaml:"socket_timeout"`
+	// FailFast makes operations fail immediately while the server is
+	// unreachable instead of retrying until SyncTimeout.
+	FailFast bool `json:"fail_fast" yaml:"fail_fast"`
+}
+
+// UberConfig holds the Uber API location and credentials.
+type UberConfig struct {
+	// BaseURL is the root of the Uber API, the sandbox by default. Point it
+	// at "manGo fake-uber" to run without Uber.
+	BaseURL string `json:"base_url" yaml:"base_url"`
+	// ServerToken authorizes the price estimate calls.
+	ServerToken string `json:"server_token" yaml:"server_token"`
+	// AccessToken is the OAuth bearer token used to request rides.
+	AccessToken string `json:"access_token" yaml:"access_token"`
+}
+
+// PlannerConfig bounds the price estimate calls made while planning.
+type PlannerConfig struct {
+	// Workers is the number of estimates fetched concurrently per trip.
+	Workers int `json:"workers" yaml:"workers"`
+	// EstimateTimeout limits each individual estimate call, including its
+	// retries, so it must leave room for every attempt and backoff
+	// allowed by UpstreamConfig.
+	EstimateTimeout Duration `json:"estimate_timeout" yaml:"estimate_timeout"`
+}
+
+// CacheConfig controls caching of price estimates by coordinate pair.
+type CacheConfig struct {
+	// Type is none, memory (an LRU cache) or mongo (persisted in the mongo
+	// store).
+	Type string   `json:"type" yaml:"type"`
+	TTL  Duration `json:"ttl" yaml:"ttl"`
+	// Size is the number of coordinate pairs kept by the memory cache.
+	Size int `json:"size" yaml:"size"`
+	// Precision is the number of decimal places coordinates are rounded to
+	// before lookup; 4 places is about 11 meters.
+	Precision int `json:"precision" yaml:"precision"`
+}
+
+// UpstreamConfig bounds and retries the calls made to Uber and Google.
+// Each service has its own circuit breaker.
+type UpstreamConfig struct {
+	// Timeout limits each attempt of a call.
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// MaxAttempts is the number of tries per call, including the first.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+	// Backoff is the wait before the first retry. It doubles for every
+	// further retry up to MaxBackoff, which also caps the Retry-After
+	// wait that is honoured.
+	Backoff    Duration `json:"backoff" yaml:"backoff"`
+	MaxBackoff Duration `json:"max_backoff" yaml:"max_backoff"`
+	// BreakerThreshold failed calls in a row open the circuit breaker, and
+	// calls fail fast for BreakerCooldown. Zero disables the breaker.
+	BreakerThreshold int      `json:"breaker_threshold" yaml:"breaker_threshold"`
+	BreakerCooldown  Duration `json:"breaker_cooldown" yaml:"breaker_cooldown"`
+}
+
+// callBudget is the longest a call can take with every attempt timing
+// out and the longest backoff before every retry.
+func (cfg UpstreamConfig) callBudget() time.Duration {
+	attempts := time.Duration(cfg.MaxAttempts)
+	return attempts*cfg.Timeout.Duration + (attempts-1)*cfg.MaxBackoff.Duration
+}
+
+// Duration is a time.Duration written as "7s" or "1m" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// stringList is a comma separated flag value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = splitList(v)
+	return nil
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen: "0.0.0.0:8080",
+		Store:  "mongo",
+		Mongo: MongoConfig{
+			Hosts:         []string{"ds043694.mongolab.com:43694"},
+			Database:      "locationdb",
+			SyncTimeout:   Duration{7 * time.Second},
+			SocketTimeout: Duration{time.Minute},
+		},
+		Uber: UberConfig{
+			BaseURL: uberSandboxURL,
+		},
+		Estimator:   "uber",
+		Offline:     defaultOfflineConfig(),
+		Geocoder:    "google",
+		GeocoderURL: googleMapsURL,
+		Planner: PlannerConfig{
+			Workers:         8,
+			EstimateTimeout: Duration{45 * time.Second},
+		},
+		Cache: CacheConfig{
+			Type:      "memory",
+			TTL:       Duration{5 * time.Minute},
+			Size:      10000,
+			Precision: 4,
+		},
+		Upstream: UpstreamConfig{
+			Timeout:          Duration{10 * time.Second},
+			MaxAttempts:      3,
+			Backoff:          Duration{200 * time.Millisecond},
+			MaxBackoff:       Duration{5 * time.Second},
+			BreakerThreshold: 5,
+			BreakerCooldown:  Duration{30 * time.Second},
+		},
+	}
+}
+
+// bindFlags registers the command-line flags on fs, writing into cfg.
+// The current contents of cfg are used as the flag defaults.
+func bindFlags(fs *flag.FlagSet, cfg *Config) *string {
+	configPath := fs.String("config", os.Getenv("MANGO_CONFIG"), "path to a YAML or JSON config file")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address the HTTP server listens on")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "storage backend for locations and trips: mongo or memory")
+	fs.Var((*stringList)(&cfg.Mongo.Hosts), "mongo-hosts", "comma separated MongoDB seed servers")
+	fs.StringVar(&cfg.Mongo.Database, "mongo-database", cfg.Mongo.Database, "MongoDB database")
+	fs.StringVar(&cfg.Mongo.Username, "mongo-username", cfg.Mongo.Username, "MongoDB user")
+	fs.StringVar(&cfg.Mongo.Password, "mongo-password", cfg.Mongo.Password, "MongoDB password")
+	fs.IntVar(&cfg.Mongo.PoolLimit, "mongo-pool-limit", cfg.Mongo.PoolLimit, "maximum MongoDB sockets per server (0 for driver default)")
+	fs.DurationVar(&cfg.Mongo.SyncTimeout.Duration, "mongo-sync-timeout", cfg.Mongo.SyncTimeout.Duration, "how long to wait for MongoDB to become reachable again")
+	fs.DurationVar(&cfg.Mongo.SocketTimeout.Duration, "mongo-socket-timeout", cfg.Mongo.SocketTimeout.Duration, "timeout for a single MongoDB socket operation")
+	fs.BoolVar(&cfg.Mongo.FailFast, "mongo-fail-fast", cfg.Mongo.FailFast, "fail MongoDB operations immediately while the server is unreachable")
+	fs.StringVar(&cfg.Uber.BaseURL, "uber-base-url", cfg.Uber.BaseURL, "root URL of the Uber API")
+	fs.StringVar(&cfg.Uber.ServerToken, "uber-server-token", cfg.Uber.ServerToken, "Uber server token for price estimates")
+	fs.StringVar(&cfg.Uber.AccessToken, "uber-access-token", cfg.Uber.AccessToken, "Uber OAuth access token for ride requests")
+	fs.StringVar(&cfg.Estimator, "estimator", cfg.Estimator, "price estimator: uber or offline")
+	fs.StringVar(&cfg.Geocoder, "geocoder", cfg.Geocoder, "address geocoder: google or gazetteer")
+	fs.StringVar(&cfg.GeocoderURL, "geocoder-url", cfg.GeocoderURL, "root URL of the Google geocoding API")
+	fs.StringVar(&cfg.Gazetteer, "gazetteer", cfg.Gazetteer, "CSV or JSON gazetteer file for the gazetteer geocoder")
+	fs.IntVar(&cfg.Planner.Workers, "planner-workers", cfg.Planner.Workers, "price estimates fetched concurrently per trip")
+	fs.DurationVar(&cfg.Planner.EstimateTimeout.Duration, "estimate-timeout", cfg.Planner.EstimateTimeout.Duration, "timeout for a single price estimate call")
+	fs.StringVar(&cfg.Cache.Type, "cache", cfg.Cache.Type, "price estimate cache: none, memory or mongo")
+	fs.DurationVar(&cfg.Cache.TTL.Duration, "cache-ttl", cfg.Cache.TTL.Duration, "how long cached price estimates are used")
+	fs.IntVar(&cfg.Cache.Size, "cache-size", cfg.Cache.Size, "coordinate pairs kept by the memory cache")
+	fs.IntVar(&cfg.Cache.Precision, "cache-precision", cfg.Cache.Precision, "decimal places coordinates are rounded to in cache keys")
+	fs.DurationVar(&cfg.Upstream.Timeout.Duration, "upstream-timeout", cfg.Upstream.Timeout.Duration, "timeout for each attempt of a call to Uber or Google")
+	fs.IntVar(&cfg.Upstream.MaxAttempts, "upstream-max-attempts", cfg.Upstream.MaxAttempts, "tries per call to Uber or Google, including the first")
+	fs.DurationVar(&cfg.Upstream.Backoff.Duration, "upstream-backoff", cfg.Upstream.Backoff.Duration, "wait before the first retry, doubled for every further one")
+	fs.DurationVar(&cfg.Upstream.MaxBackoff.Duration, "upstream-max-backoff", cfg.Upstream.MaxBackoff.Duration, "longest wait between retries, including Retry-After")
+	fs.IntVar(&cfg.Upstream.BreakerThreshold, "breaker-threshold", cfg.Upstream.BreakerThreshold, "failed calls in a row that open the circuit breaker (0 to disable)")
+	fs.DurationVar(&cfg.Upstream.BreakerCooldown.Duration, "breaker-cooldown", cfg.Upstream.BreakerCooldown.Duration, "how long an open circuit breaker fails calls fast")
+	fs.Float64Var(&cfg.Offline.AverageSpeedMph, "offline-speed-mph", cfg.Offline.AverageSpeedMph, "average speed used by the offline estimator")
+	return configPath
+}
+
+// loadConfig resolves the configuration from defaults, file, environment
+// and args, then validates it.
+func loadConfig(args []string) (*Config, error) {
+	// The first pass only finds the config file; flags are applied for
+	// real once the file and environment have been read.
+	probe := flag.NewFlagSet("manGo", flag.ContinueOnError)
+	configPath := bindFlags(probe, defaultConfig())
+	if err := probe.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(cfg, os.Getenv); err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet("manGo", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	bindFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile merges the file at path into cfg, which is a *Config or
+// another configuration struct. Files ending in .json are decoded as JSON,
+// everything else as YAML.
+func readConfigFile(path string, cfg interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		// Reject unknown keys like the YAML decoder does
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	} else {
+		err = yaml.UnmarshalStrict(data, cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides cfg with any MANGO_* variables returned by getenv.
+func applyEnv(cfg *Config, getenv func(string) string) error {
+	strs := map[string]*string{
+		"MANGO_LISTEN":            &cfg.Listen,
+		"MANGO_STORE":             &cfg.Store,
+		"MANGO_MONGO_DATABASE":    &cfg.Mongo.Database,
+		"MANGO_MONGO_USERNAME":    &cfg.Mongo.Username,
+		"MANGO_MONGO_PASSWORD":    &cfg.Mongo.Password,
+		"MANGO_UBER_BASE_URL":     &cfg.Uber.BaseURL,
+		"MANGO_UBER_SERVER_TOKEN": &cfg.Uber.ServerToken,
+		"MANGO_UBER_ACCESS_TOKEN": &cfg.Uber.AccessToken,
+		"MANGO_ESTIMATOR":         &cfg.Estimator,
+		"MANGO_GEOCODER":          &cfg.Geocoder,
+		"MANGO_GEOCODER_URL":      &cfg.GeocoderURL,
+		"MANGO_GAZETTEER":         &cfg.Gazetteer,
+		"MANGO_CACHE":             &cfg.Cache.Type,
+	}
+	for name, p := range strs {
+		if v := getenv(name); v != "" {
+			*p = v
+		}
+	}
+
+	durations := map[string]*Duration{
+		"MANGO_MONGO_SYNC_TIMEOUT":   &cfg.Mongo.SyncTimeout,
+		"MANGO_MONGO_SOCKET_TIMEOUT": &cfg.Mongo.SocketTimeout,
+		"MANGO_ESTIMATE_TIMEOUT":     &cfg.Planner.EstimateTimeout,
+		"MANGO_CACHE_TTL":            &cfg.Cache.TTL,
+		"MANGO_UPSTREAM_TIMEOUT":     &cfg.Upstream.Timeout,
+		"MANGO_UPSTREAM_BACKOFF":     &cfg.Upstream.Backoff,
+		"MANGO_UPSTREAM_MAX_BACKOFF": &cfg.Upstream.MaxBackoff,
+		"MANGO_BREAKER_COOLDOWN":     &cfg.Upstream.BreakerCooldown,
+	}
+	for name, p := range durations {
+		if v := getenv(name); v != "" {
+			if err := p.UnmarshalText([]byte(v)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	if v := getenv("MANGO_MONGO_HOSTS"); v != "" {
+		cfg.Mongo.Hosts = splitList(v)
+	}
+	if v := getenv("MANGO_MONGO_POOL_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_MONGO_POOL_LIMIT: %v", err)
+		}
+		cfg.Mongo.PoolLimit = n
+	}
+	if v := getenv("MANGO_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_CACHE_SIZE: %v", err)
+		}
+		cfg.Cache.Size = n
+	}
+	if v := getenv("MANGO_CACHE_PRECISION"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_CACHE_PRECISION: %v", err)
+		}
+		cfg.Cache.Precision = n
+	}
+	if v := getenv("MANGO_PLANNER_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_PLANNER_WORKERS: %v", err)
+		}
+		cfg.Planner.Workers = n
+	}
+	if v := getenv("MANGO_UPSTREAM_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_UPSTREAM_MAX_ATTEMPTS: %v", err)
+		}
+		cfg.Upstream.MaxAttempts = n
+	}
+	if v := getenv("MANGO_BREAKER_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_BREAKER_THRESHOLD: %v", err)
+		}
+		cfg.Upstream.BreakerThreshold = n
+	}
+	if v := getenv("MANGO_MONGO_FAIL_FAST"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("MANGO_MONGO_FAIL_FAST: %v", err)
+		}
+		cfg.Mongo.FailFast = b
+	}
+	return nil
+}
+
+// Validate reports the first setting that would stop the service from
+// working.
+func (cfg *Config) Validate() error {
+	if cfg.Listen == "" {
+		return errors.New("config: listen address is required")
+	}
+	switch cfg.Store {
+	case "memory":
+	case "mongo":
+		if len(cfg.Mongo.Hosts) == 0 {
+			return errors.New("config: mongo.hosts is required for the mongo store")
+		}
+		if cfg.Mongo.Database == "" {
+			return errors.New("config: mongo.database is required for the mongo store")
+		}
+		if cfg.Mongo.Username == "" || cfg.Mongo.Password == "" {
+			return errors.New("config: mongo.username and mongo.password are required for the mongo store")
+		}
+		if cfg.Mongo.PoolLimit < 0 {
+			return errors.New("config: mongo.pool_limit must not be negative")
+		}
+	default:
+		return fmt.Errorf("config: unknown store %q, want mongo or memory", cfg.Store)
+	}
+	if cfg.Planner.Workers < 1 {
+		return errors.New("config: planner.workers must be at least 1")
+	}
+	if cfg.Planner.EstimateTimeout.Duration <= 0 {
+		return errors.New("config: planner.estimate_timeout must be positive")
+	}
+	switch cfg.Cache.Type {
+	case "none":
+	case "memory", "mongo":
+		if cfg.Cache.Type == "memory" && cfg.Cache.Size < 1 {
+			return errors.New("config: cache.size must be at least 1")
+		}
+		if cfg.Cache.Type == "mongo" && cfg.Store != "mongo" {
+			return errors.New("config: the mongo cache needs the mongo store")
+		}
+		if cfg.Cache.TTL.Duration <= 0 {
+			return errors.New("config: cache.ttl must be positive")
+		}
+		if cfg.Cache.Precision < 0 {
+			return errors.New("config: cache.precision must not be negative")
+		}
+	default:
+		return fmt.Errorf("config: unknown cache %q, want none, memory or mongo", cfg.Cache.Type)
+	}
+	if cfg.Upstream.Timeout.Duration <= 0 {
+		return errors.New("config: upstream.timeout must be positive")
+	}
+	if cfg.Upstream.MaxAttempts < 1 {
+		return errors.New("config: upstream.max_attempts must be at least 1")
+	}
+	if cfg.Upstream.Backoff.Duration < 0 || cfg.Upstream.MaxBackoff.Duration < cfg.Upstream.Backoff.Duration {
+		return errors.New("config: upstream.backoff must not be negative or above upstream.max_backoff")
+	}
+	if budget := cfg.Upstream.callBudget(); cfg.Planner.EstimateTimeout.Duration <= budget {
+		return fmt.Errorf("config: planner.estimate_timeout must be above %v, the longest a call with its retries can take under upstream", budget)
+	}
+	if cfg.Upstream.BreakerThreshold < 0 {
+		return errors.New("config: upstream.breaker_threshold must not be negative")
+	}
+	if cfg.Upstream.BreakerThreshold > 0 && cfg.Upstream.BreakerCooldown.Duration <= 0 {
+		return errors.New("config: upstream.breaker_cooldown must be positive")
+	}
+	if cfg.Uber.BaseURL == "" {
+		return errors.New("config: uber.base_url is required")
+	}
+	switch cfg.Estimator {
+	case "uber":
+		if cfg.Uber.ServerToken == "" {
+			return errors.New("config: uber.server_token is required for the uber estimator")
+		}
+	case "offline":
+		if cfg.Offline.AverageSpeedMph <= 0 {
+			return errors.New("config: offline.average_speed_mph must be positive")
+		}
+		if len(cfg.Offline.Products) == 0 {
+			return errors.New("config: offline.products needs at least one rate card")
+		}
+		for _, p := range cfg.Offline.Products {
+			if p.ProductId == "" {
+				return errors.New("config: offline.products entries need a product_id")
+			}
+		}
+	default:
+		return fmt.Errorf("config: unknown estimator %q, want uber or offline", cfg.Estimator)
+	}
+	switch cfg.Geocoder {
+	case "google":
+		if cfg.GeocoderURL == "" {
+			return errors.New("config: geocoder_url is required for the google geocoder")
+		}
+	case "gazetteer":
+		if cfg.Gazetteer == "" {
+			return errors.New("config: gazetteer file is required for the gazetteer geocoder")
+		}
+	default:
+		return fmt.Errorf("config: unknown geocoder %q, want google or gazetteer", cfg.Geocoder)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// APIError is the JSON body written for every failed request.
+type APIError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code, message string, details interface{}) *APIError {
+	return &APIError{Status: status, Code: code, Message: message, Details: details}
+}
+
+// writeError sends err to the client. Errors that are not an *APIError are
+// reported as internal errors without exposing their text.
+func writeError(rw http.ResponseWriter, err error) {
+	var apiErr *APIError
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		apiErr = newAPIError(http.StatusConflict, "invalid_transition", transitionErr.Error(), map[string]interface{}{"from": transitionErr.From, "to": transitionErr.To})
+	} else if !errors.As(err, &apiErr) {
+		log.Println(err)
+		apiErr = newAPIError(http.StatusInternalServerError, "internal_error", "Internal server error.", nil)
+	}
+
+	body, _ := json.Marshal(apiErr)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(apiErr.Status)
+	rw.Write(append(body, '\n'))
+}
+
+// writeJSON sends v as the body of a successful response.
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(append(body, '\n'))
+}
+
+// storeError maps an error from a LocationStore or TripStore. ErrNotFound
+// becomes a 404 naming what was looked up, ErrDuplicate and ErrConflict a
+// 409, anything else means the database is unavailable.
+func storeError(err error, what string, id interface{}) *APIError {
+	if err == ErrNotFound {
+		return newAPIError(http.StatusNotFound, what+"_not_found", "No such "+what+" found.", map[string]interface{}{what + "_id": id})
+	}
+	if err == ErrConflict {
+		return newAPIError(http.StatusConflict, "invalid_transition", "The "+what+" was changed by another request.", map[string]interface{}{what + "_id": id})
+	}
+	if err == ErrDuplicate {
+		return newAPIError(http.StatusConflict, what+"_exists", "A "+what+" with this id already exists.", map[string]interface{}{what + "_id": id})
+	}
+	log.Println("store:", err)
+	return newAPIError(http.StatusServiceUnavailable, "store_unavailable", "The database is unavailable.", nil)
+}
+
+// upstreamError maps a failed call to Uber or Google. Timeouts and calls
+// refused by an open circuit breaker are reported as 503, every other
+// failure as 502.
+func upstreamError(service string, err error) *APIError {
+	details := map[string]interface{}{"service": service, "error": err.Error()}
+	if errors.Is(err, ErrCircuitOpen) {
+		return newAPIError(http.StatusServiceUnavailable, "upstream_unavailable", service+" is unavailable, try again later.", details)
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return newAPIError(http.StatusServiceUnavailable, "upstream_timeout", service+" did not respond in time.", details)
+	}
+	return newAPIError(http.StatusBadGateway, "upstream_error", service+" request failed.", details)
+}
+
+// geocodeError maps a failed Geocoder lookup. An unknown address is the
+// client's fault, anything else an upstream failure.
+func geocodeError(err error, address string) *APIError {
+	if err == ErrAddressNotFound {
+		return newAPIError(http.StatusBadRequest, "address_not_found", "Address could not be geocoded.", map[string]interface{}{"address": address})
+	}
+	return upstreamError("Geocoder", err)
+}
+
+// parseId reads the numeric route parameter name.
+func parseId(p httprouter.Params, name string) (int64, error) {
+	id, err := strconv.ParseInt(p.ByName(name), 10, 64)
+	if err != nil {
+		return 0, newAPIError(http.StatusBadRequest, "invalid_id", name+" must be an integer.", map[string]interface{}{name: p.ByName(name)})
+	}
+	return id, nil
+}
+
+// readJSON decodes the request body into v.
+func readJSON(req *http.Request, v interface{}) error {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid_body", "Request body is not valid JSON.", map[string]interface{}{"error": err.Error()})
+	}
+	return nil
+}
+
+// handleNotFound, handleMethodNotAllowed and handlePanic make the router
+// answer with the same JSON errors as the handlers.
+func handleNotFound(rw http.ResponseWriter, req *http.Request) {
+	writeError(rw, newAPIError(http.StatusNotFound, "route_not_found", "No such route.", map[string]interface{}{"path": req.URL.Path}))
+}
+
+func handleMethodNotAllowed(rw http.ResponseWriter, req *http.Request) {
+	writeError(rw, newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", req.Method+" is not allowed on this route.", nil))
+}
+
+func handlePanic(rw http.ResponseWriter, req *http.Request, v interface{}) {
+	log.Printf("panic serving %s %s: %v", req.Method, req.URL.Path, v)
+	writeError(rw, newAPIError(http.StatusInternalServerError, "internal_error", "Internal server error.", nil))
+}
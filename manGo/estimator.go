@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ProductEstimate is the price of one product between two coordinates, as
+// returned by GET /v1/estimates/price.
+type ProductEstimate struct {
+	Product_id    string `json:"product_id"`
+	Display_name  string `json:"display_name"`
+	Currency_code string `json:"currency_code"`
+	Estimate      string `json:"estimate"`
+	// Low_estimate and High_estimate are nil for metered products that
+	// have no upfront price.
+	Low_estimate     *float64 `json:"low_estimate"`
+	High_estimate    *float64 `json:"high_estimate"`
+	Surge_multiplier float64  `json:"surge_multiplier"`
+	// Duration is in seconds, Distance in miles.
+	Duration float64 `json:"duration"`
+	Distance float64 `json:"distance"`
+}
+
+// PriceEstimator returns the price of every available product for a ride
+// between two coordinates. Implementations must be safe for concurrent use
+// and give up once ctx is done.
+type PriceEstimator interface {
+	Estimate(ctx context.Context, from, to LocationLatLng) ([]ProductEstimate, error)
+}
+
+var priceEstimator PriceEstimator
+
+// UnpricedProduct is an available product without an upfront price, such
+// as a metered taxi. Estimate is the text Uber shows instead of a price.
+type UnpricedProduct struct {
+	Product_id   string
+	Display_name string
+	Estimate     string
+}
+
+// priced reports whether the product has a usable upfront price.
+func (e ProductEstimate) priced() bool {
+	return e.Low_estimate != nil && *e.Low_estimate >= 0 && !math.IsInf(*e.Low_estimate, 0)
+}
+
+// unpricedProducts returns the products of estimates without an upfront
+// price, or nil if every product is priced.
+func unpricedProducts(estimates []ProductEstimate) []UnpricedProduct {
+	var unpriced []UnpricedProduct
+	for _, e := range estimates {
+		if !e.priced() {
+			unpriced = append(unpriced, UnpricedProduct{Product_id: e.Product_id, Display_name: e.Display_name, Estimate: e.Estimate})
+		}
+	}
+	return unpriced
+}
+
+// cost returns the low estimate, or zero for unpriced products.
+func (e ProductEstimate) cost() float64 {
+	if !e.priced() {
+		return 0
+	}
+	return *e.Low_estimate
+}
+
+// uberEstimator queries the Uber price estimates API.
+type uberEstimator struct {
+	baseURL     string
+	serverToken string
+	client      *upstreamClient
+}
+
+func newUberEstimator(baseURL, serverToken string, client *upstreamClient) *uberEstimator {
+	return &uberEstimator{
+		baseURL:     baseURL,
+		serverToken: serverToken,
+		client:      client,
+	}
+}
+
+func (u *uberEstimator) Estimate(ctx context.Context, from, to LocationLatLng) ([]ProductEstimate, error) {
+	query := url.Values{}
+	query.Set("start_latitude", strconv.FormatFloat(from.Lat, 'f', 7, 64))
+	query.Set("start_longitude", strconv.FormatFloat(from.Lng, 'f', 7, 64))
+	query.Set("end_latitude", strconv.FormatFloat(to.Lat, 'f', 7, 64))
+	query.Set("end_longitude", strconv.FormatFloat(to.Lng, 'f', 7, 64))
+
+	request, err := http.NewRequestWithContext(ctx, "GET", u.baseURL+"/v1/estimates/price?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Token "+u.serverToken)
+	resp, err := u.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, uberStatusError("uber price estimates", resp)
+	}
+
+	// A missing prices array is no products rather than an error; the
+	// planner reports the ride as unreachable.
+	var body struct {
+		Prices []ProductEstimate `json:"prices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("uber price estimates: %v", err)
+	}
+	return body.Prices, nil
+}
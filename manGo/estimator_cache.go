@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EstimateCache stores price estimates by coordinate pair. Entries expire
+// after the TTL the cache was created with.
+type EstimateCache interface {
+	Get(key string) ([]ProductEstimate, bool)
+	Set(key string, estimates []ProductEstimate)
+}
+
+// CacheStats counts lookups served by a cachingEstimator.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// cachingEstimator answers repeated estimates for the same coordinates from
+// a cache and only calls next on a miss.
+type cachingEstimator struct {
+	next  PriceEstimator
+	cache EstimateCache
+	// precision is the number of decimal places coordinates are rounded to
+	// in cache keys; 4 places is about 11 meters.
+	precision int
+
+	hits   uint64
+	misses uint64
+}
+
+// estimateCache is set when estimates are cached, for reporting its stats.
+var estimateCache *cachingEstimator
+
+func newCachingEstimator(next PriceEstimator, cache EstimateCache, precision int) *cachingEstimator {
+	return &cachingEstimator{next: next, cache: cache, precision: precision}
+}
+
+func (c *cachingEstimator) Estimate(ctx context.Context, from, to LocationLatLng) ([]ProductEstimate, error) {
+	key := c.key(from, to)
+	if estimates, ok := c.cache.Get(key); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return estimates, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	estimates, err := c.next.Estimate(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Set(key, estimates)
+	return estimates, nil
+}
+
+func (c *cachingEstimator) key(from, to LocationLatLng) string {
+	return fmt.Sprintf("%.*f,%.*f:%.*f,%.*f",
+		c.precision, from.Lat, c.precision, from.Lng,
+		c.precision, to.Lat, c.precision, to.Lng)
+}
+
+// Stats returns the hit and miss counts since startup.
+func (c *cachingEstimator) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// lruCache is an in-memory EstimateCache holding at most size entries,
+// evicting the least recently used one first.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key       string
+	estimates []ProductEstimate
+	expires   time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(key string) ([]ProductEstimate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.estimates, true
+}
+
+func (c *lruCache) Set(key string, estimates []ProductEstimate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry)
+		entry.estimates = estimates
+		entry.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, estimates: estimates, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	for _, tc := range []struct {
+		name string
+		// ops are "set <key>", "get <key>" or "wait", which outlasts the TTL
+		ops        []string
+		hit, miss  []string
+		wantLength int
+	}{
+		{"evicts the oldest", []string{"set a", "set b", "set c"}, []string{"b", "c"}, []string{"a"}, 2},
+		{"get keeps an entry", []string{"set a", "set b", "get a", "set c"}, []string{"a", "c"}, []string{"b"}, 2},
+		{"set keeps an entry", []string{"set a", "set b", "set a", "set c"}, []string{"a", "c"}, []string{"b"}, 2},
+		{"expires", []string{"set a", "wait", "set b"}, []string{"b"}, []string{"a"}, 1},
+		{"set renews", []string{"set a", "wait", "set a"}, []string{"a"}, nil, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newLRUCache(2, ttl)
+			for _, op := range tc.ops {
+				fields := strings.Fields(op)
+				switch fields[0] {
+				case "set":
+					c.Set(fields[1], []ProductEstimate{{Product_id: fields[1]}})
+				case "get":
+					c.Get(fields[1])
+				case "wait":
+					time.Sleep(ttl + 10*time.Millisecond)
+				}
+			}
+
+			for _, key := range tc.miss {
+				if _, ok := c.Get(key); ok {
+					t.Errorf("%s is cached", key)
+				}
+			}
+			for _, key := range tc.hit {
+				if estimates, ok := c.Get(key); !ok || estimates[0].Product_id != key {
+					t.Errorf("%s: %v, %v", key, estimates, ok)
+				}
+			}
+			if c.order.Len() != tc.wantLength || len(c.entries) != tc.wantLength {
+				t.Errorf("%d entries in order, %d in map, want %d", c.order.Len(), len(c.entries), tc.wantLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// earthRadiusMiles is the mean radius of the earth used for great-circle
+// distances.
+const earthRadiusMiles = 3958.8
+
+// RateCard prices one product for the offline estimator.
+type RateCard struct {
+	ProductId   string `json:"product_id" yaml:"product_id"`
+	DisplayName string `json:"display_name" yaml:"display_name"`
+	// BaseFare is charged once per ride, PerMile and PerMinute on top of it.
+	BaseFare  float64 `json:"base_fare" yaml:"base_fare"`
+	PerMile   float64 `json:"per_mile" yaml:"per_mile"`
+	PerMinute float64 `json:"per_minute" yaml:"per_minute"`
+	// Minimum is the lowest fare charged for any ride.
+	Minimum float64 `json:"minimum" yaml:"minimum"`
+}
+
+// OfflineConfig configures the offline price estimator.
+type OfflineConfig struct {
+	// AverageSpeedMph converts great-circle distance into ride duration.
+	AverageSpeedMph float64    `json:"average_speed_mph" yaml:"average_speed_mph"`
+	Products        []RateCard `json:"products" yaml:"products"`
+}
+
+func defaultOfflineConfig() OfflineConfig {
+	return OfflineConfig{
+		AverageSpeedMph: 25,
+		Products: []RateCard{
+			{ProductId: "offline-uberx", DisplayName: "uberX", BaseFare: 2.00, PerMile: 1.30, PerMinute: 0.26, Minimum: 6.55},
+			{ProductId: "offline-uberxl", DisplayName: "uberXL", BaseFare: 3.85, PerMile: 2.85, PerMinute: 0.50, Minimum: 8.55},
+			{ProductId: "offline-uberblack", DisplayName: "UberBLACK", BaseFare: 8.00, PerMile: 3.75, PerMinute: 0.65, Minimum: 15.00},
+		},
+	}
+}
+
+// offlineEstimator prices rides from great-circle distance and a rate card
+// without any network access. The same coordinates always produce the same
+// estimates.
+type offlineEstimator struct {
+	speedMph float64
+	products []RateCard
+}
+
+func newOfflineEstimator(cfg OfflineConfig) *offlineEstimator {
+	return &offlineEstimator{
+		speedMph: cfg.AverageSpeedMph,
+		products: cfg.Products,
+	}
+}
+
+func (o *offlineEstimator) Estimate(ctx context.Context, from, to LocationLatLng) ([]ProductEstimate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	distance := haversineMiles(from, to)
+	duration := math.Round(distance / o.speedMph * 3600)
+
+	estimates := make([]ProductEstimate, 0, len(o.products))
+	for _, p := range o.products {
+		fare := p.BaseFare + p.PerMile*distance + p.PerMinute*duration/60
+		if fare < p.Minimum {
+			fare = p.Minimum
+		}
+		low := math.Round(fare)
+		high := math.Round(fare * 1.25)
+
+		estimates = append(estimates, ProductEstimate{
+			Product_id:       p.ProductId,
+			Display_name:     p.DisplayName,
+			Currency_code:    "USD",
+			Estimate:         fmt.Sprintf("$%.0f-%.0f", low, high),
+			Low_estimate:     &low,
+			High_estimate:    &high,
+			Surge_multiplier: 1,
+			Duration:         duration,
+			Distance:         math.Round(distance*100) / 100,
+		})
+	}
+	return estimates, nil
+}
+
+// haversineMiles returns the great-circle distance between two coordinates.
+func haversineMiles(from, to LocationLatLng) float64 {
+	lat1 := from.Lat * math.Pi / 180
+	lat2 := to.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (to.Lng - from.Lng) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeGeocodeFixture is an address known to the fake geocoding API. Status
+// makes lookups of the address answer with that status instead, such as
+// OVER_QUERY_LIMIT or REQUEST_DENIED.
+type FakeGeocodeFixture struct {
+	Address string  `json:"address"`
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+	Status  string  `json:"status"`
+}
+
+// FakeGoogleConfig configures the stand-in for the Google Geocoding API
+// that is served by "manGo fake-google" and used by the tests.
+type FakeGoogleConfig struct {
+	Listen   string
+	Fixtures []FakeGeocodeFixture
+	// QueryLimit is the number of lookups answered before every further
+	// one gets OVER_QUERY_LIMIT; zero means no limit.
+	QueryLimit int
+	Latency    time.Duration
+}
+
+// fakeGoogle answers GET /maps/api/geocode/json like the Google Geocoding
+// API: known addresses with status OK and their location, unknown ones
+// with ZERO_RESULTS. Addresses are matched like the gazetteer geocoder
+// does.
+type fakeGoogle struct {
+	cfg      FakeGoogleConfig
+	fixtures map[string]FakeGeocodeFixture
+
+	mu      sync.Mutex
+	queries int
+}
+
+func newFakeGoogle(cfg FakeGoogleConfig) *fakeGoogle {
+	f := &fakeGoogle{cfg: cfg, fixtures: make(map[string]FakeGeocodeFixture)}
+	for _, fixture := range cfg.Fixtures {
+		f.fixtures[normalizeAddress(fixture.Address)] = fixture
+	}
+	return f
+}
+
+// fakeGeocodeResult is one entry of the results array.
+type fakeGeocodeResult struct {
+	Formatted_address string `json:"formatted_address"`
+	Geometry          struct {
+		Location struct {
+			Lat float64 `json:"lat"`
+			Lng float64 `json:"lng"`
+		} `json:"location"`
+		Location_type string `json:"location_type"`
+	} `json:"geometry"`
+}
+
+func (f *fakeGoogle) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/maps/api/geocode/json" {
+		http.NotFound(rw, req)
+		return
+	}
+	if f.cfg.Latency > 0 {
+		select {
+		case <-time.After(f.cfg.Latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	f.mu.Lock()
+	f.queries++
+	overLimit := f.cfg.QueryLimit > 0 && f.queries > f.cfg.QueryLimit
+	f.mu.Unlock()
+	if overLimit {
+		writeFakeGeocode(rw, "OVER_QUERY_LIMIT", "You have exceeded your rate-limit for this API.", nil)
+		return
+	}
+
+	address := req.URL.Query().Get("address")
+	if strings.TrimSpace(address) == "" {
+		writeFakeGeocode(rw, "INVALID_REQUEST", "Invalid request. Missing the 'address' parameter.", nil)
+		return
+	}
+
+	for _, key := range addressKeys(address) {
+		fixture, ok := f.fixtures[key]
+		if !ok {
+			continue
+		}
+		if fixture.Status != "" && fixture.Status != "OK" {
+			writeFakeGeocode(rw, fixture.Status, "Status set by the fixture for this address.", nil)
+			return
+		}
+		var result fakeGeocodeResult
+		result.Formatted_address = fixture.Address
+		result.Geometry.Location.Lat = fixture.Lat
+		result.Geometry.Location.Lng = fixture.Lng
+		result.Geometry.Location_type = "ROOFTOP"
+		writeFakeGeocode(rw, "OK", "", []fakeGeocodeResult{result})
+		return
+	}
+	writeFakeGeocode(rw, "ZERO_RESULTS", "", nil)
+}
+
+// writeFakeGeocode answers with HTTP 200 like Google does, reporting
+// failures in the status field.
+func writeFakeGeocode(rw http.ResponseWriter, status, message string, results []fakeGeocodeResult) {
+	if results == nil {
+		results = []fakeGeocodeResult{}
+	}
+	body := map[string]interface{}{"status": status, "results": results}
+	if message != "" {
+		body["error_message"] = message
+	}
+	b, _ := json.Marshal(body)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
+
+// loadGeocodeFixtures reads fixtures from a .json file holding a list of
+// FakeGeocodeFixture, or from a gazetteer CSV file with address,lat,lng
+// columns.
+func loadGeocodeFixtures(path string) ([]FakeGeocodeFixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fixtures []FakeGeocodeFixture
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.NewDecoder(f).Decode(&fixtures)
+	} else {
+		var entries []GazetteerEntry
+		entries, err = readGazetteerCSV(f)
+		for _, e := range entries {
+			fixtures = append(fixtures, FakeGeocodeFixture{Address: e.Address, Lat: e.Lat, Lng: e.Lng})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fixtures %s: %v", path, err)
+	}
+	return fixtures, nil
+}
+
+// runFakeGoogle serves the fake geocoding API until the process is
+// stopped. It backs the "fake-google" subcommand.
+func runFakeGoogle(args []string) error {
+	cfg := FakeGoogleConfig{}
+	fs := flag.NewFlagSet("manGo fake-google", flag.ContinueOnError)
+	fs.StringVar(&cfg.Listen, "listen", "127.0.0.1:9091", "address the fake geocoding API listens on")
+	fixtures := fs.String("fixtures", "", "CSV or JSON file with the known addresses")
+	fs.IntVar(&cfg.QueryLimit, "query-limit", 0, "lookups answered before OVER_QUERY_LIMIT (0 for no limit)")
+	fs.DurationVar(&cfg.Latency, "latency", 0, "delay before every response")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fixtures == "" {
+		return errors.New("fake-google: -fixtures is required")
+	}
+
+	var err error
+	cfg.Fixtures, err = loadGeocodeFixtures(*fixtures)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("fake geocoding API listening on %s with %d addresses", cfg.Listen, len(cfg.Fixtures))
+	return http.ListenAndServe(cfg.Listen, newFakeGoogle(cfg))
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Endpoints of the fake Uber API that failures can be injected into.
+const (
+	fakeUberEstimates = "estimates"
+	fakeUberRequests  = "requests"
+	fakeUberSandbox   = "sandbox"
+	fakeUberCancel    = "cancel"
+)
+
+// FakeUberConfig configures the stand-in for the Uber sandbox API that is
+// served by "manGo fake-uber" and used by the tests.
+type FakeUberConfig struct {
+	Listen string `json:"listen" yaml:"listen"`
+	// AverageSpeedMph and Products price rides like the offline estimator.
+	AverageSpeedMph float64       `json:"average_speed_mph" yaml:"average_speed_mph"`
+	Products        []FakeProduct `json:"products" yaml:"products"`
+	// Eta is the pickup time in minutes reported for every ride request.
+	Eta float64 `json:"eta" yaml:"eta"`
+	// Surge multiplies the fares of products without a surge of their own.
+	Surge float64 `json:"surge" yaml:"surge"`
+	// Latency delays every response.
+	Latency Duration `json:"latency" yaml:"latency"`
+	// FailRate is the share of calls, from 0 to 1, answered with
+	// FailStatus instead. FailEndpoints limits the failures to some of
+	// estimates, requests, sandbox and cancel; empty means all of them.
+	FailRate      float64  `json:"fail_rate" yaml:"fail_rate"`
+	FailStatus    int      `json:"fail_status" yaml:"fail_status"`
+	FailEndpoints []string `json:"fail_endpoints" yaml:"fail_endpoints"`
+	// RetryAfter is sent as the Retry-After header of injected failures
+	// when set.
+	RetryAfter Duration `json:"retry_after" yaml:"retry_after"`
+}
+
+// FakeProduct is a product offered by the fake Uber API.
+type FakeProduct struct {
+	RateCard `yaml:",inline"`
+	// Surge overrides FakeUberConfig.Surge for this product when set.
+	Surge float64 `json:"surge" yaml:"surge"`
+	// Metered products have no upfront price.
+	Metered bool `json:"metered" yaml:"metered"`
+	// Delay is added to the duration of every ride, in seconds.
+	Delay float64 `json:"delay" yaml:"delay"`
+}
+
+func defaultFakeUberConfig() FakeUberConfig {
+	offline := defaultOfflineConfig()
+	products := make([]FakeProduct, len(offline.Products))
+	for i, card := range offline.Products {
+		products[i] = FakeProduct{RateCard: card}
+	}
+	return FakeUberConfig{
+		Listen:          "127.0.0.1:9090",
+		AverageSpeedMph: offline.AverageSpeedMph,
+		Products:        products,
+		Eta:             5,
+		Surge:           1,
+		FailStatus:      http.StatusInternalServerError,
+	}
+}
+
+// fakeRide is a ride booked through the fake Uber API.
+type fakeRide struct {
+	Request_id string  `json:"request_id"`
+	Product_id string  `json:"product_id"`
+	Status     string  `json:"status"`
+	Eta        float64 `json:"eta"`
+}
+
+// fakeUber implements the parts of the Uber API that manGo uses: price
+// estimates, ride requests, sandbox ride updates and cancellation. It
+// keeps booked rides in memory.
+type fakeUber struct {
+	cfg      FakeUberConfig
+	router   *httprouter.Router
+	products map[string]FakeProduct
+	pricing  *offlineEstimator
+
+	mu    sync.Mutex
+	rides map[string]*fakeRide
+	seq   int
+}
+
+func newFakeUber(cfg FakeUberConfig) *fakeUber {
+	f := &fakeUber{
+		cfg:      cfg,
+		router:   httprouter.New(),
+		products: make(map[string]FakeProduct),
+		rides:    make(map[string]*fakeRide),
+	}
+
+	cards := make([]RateCard, len(cfg.Products))
+	for i, p := range cfg.Products {
+		cards[i] = p.RateCard
+		f.products[p.ProductId] = p
+	}
+	f.pricing = newOfflineEstimator(OfflineConfig{AverageSpeedMph: cfg.AverageSpeedMph, Products: cards})
+
+	f.router.GET("/v1/estimates/price", f.inject(fakeUberEstimates, f.estimates))
+	f.router.POST("/v1/requests", f.inject(fakeUberRequests, f.request))
+	f.router.GET("/v1/requests/:request_id", f.inject(fakeUberRequests, f.getRequest))
+	f.router.DELETE("/v1/requests/:request_id", f.inject(fakeUberCancel, f.cancel))
+	f.router.PUT("/v1/sandbox/requests/:request_id", f.inject(fakeUberSandbox, f.updateSandbox))
+	return f
+}
+
+func (f *fakeUber) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.router.ServeHTTP(rw, req)
+}
+
+// inject wraps an endpoint with the configured latency, failures and the
+// authorization check of the real API.
+func (f *fakeUber) inject(endpoint string, h httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		if f.cfg.Latency.Duration > 0 {
+			select {
+			case <-time.After(f.cfg.Latency.Duration):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if f.fails(endpoint) {
+			if f.cfg.RetryAfter.Duration > 0 {
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(f.cfg.RetryAfter.Seconds()))))
+			}
+			writeFakeUberError(rw, f.cfg.FailStatus, "injected_failure", "Failure injected by the fake Uber API.")
+			return
+		}
+		if req.Header.Get("Authorization") == "" {
+			writeFakeUberError(rw, http.StatusUnauthorized, "unauthorized", "Invalid OAuth 2.0 credentials provided.")
+			return
+		}
+		h(rw, req, p)
+	}
+}
+
+func (f *fakeUber) fails(endpoint string) bool {
+	if f.cfg.FailRate <= 0 {
+		return false
+	}
+	if len(f.cfg.FailEndpoints) > 0 {
+		found := false
+		for _, e := range f.cfg.FailEndpoints {
+			found = found || e == endpoint
+		}
+		if !found {
+			return false
+		}
+	}
+	return rand.Float64() < f.cfg.FailRate
+}
+
+// GET /v1/estimates/price
+func (f *fakeUber) estimates(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	var coords [4]float64
+	for i, name := range []string{"start_latitude", "start_longitude", "end_latitude", "end_longitude"} {
+		v, err := strconv.ParseFloat(req.URL.Query().Get(name), 64)
+		if err != nil {
+			writeFakeUberError(rw, http.StatusUnprocessableEntity, "validation_failed", name+" is required and must be a number.")
+			return
+		}
+		coords[i] = v
+	}
+
+	estimates, err := f.pricing.Estimate(req.Context(),
+		LocationLatLng{Lat: coords[0], Lng: coords[1]},
+		LocationLatLng{Lat: coords[2], Lng: coords[3]})
+	if err != nil {
+		return
+	}
+	for i := range estimates {
+		product := f.products[estimates[i].Product_id]
+		estimates[i].Duration += product.Delay
+		if product.Metered {
+			estimates[i].Low_estimate = nil
+			estimates[i].High_estimate = nil
+			estimates[i].Estimate = "Metered"
+			continue
+		}
+		surge := f.cfg.Surge
+		if product.Surge > 0 {
+			surge = product.Surge
+		}
+		if surge > 0 && surge != 1 {
+			low := math.Round(*estimates[i].Low_estimate * surge)
+			high := math.Round(*estimates[i].High_estimate * surge)
+			estimates[i].Low_estimate = &low
+			estimates[i].High_estimate = &high
+			estimates[i].Estimate = fmt.Sprintf("$%.0f-%.0f", low, high)
+			estimates[i].Surge_multiplier = surge
+		}
+	}
+	writeFakeUberJSON(rw, http.StatusOK, map[string]interface{}{"prices": estimates})
+}
+
+// POST /v1/requests
+func (f *fakeUber) request(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	var body PostRequestBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeFakeUberError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if _, ok := f.products[body.Product_id]; !ok {
+		writeFakeUberError(rw, http.StatusNotFound, "not_found", "Invalid product_id.")
+		return
+	}
+
+	f.mu.Lock()
+	f.seq++
+	ride := &fakeRide{
+		Request_id: fmt.Sprintf("fake-%d", f.seq),
+		Product_id: body.Product_id,
+		Status:     "processing",
+		Eta:        f.cfg.Eta,
+	}
+	f.rides[ride.Request_id] = ride
+	copied := *ride
+	f.mu.Unlock()
+
+	writeFakeUberJSON(rw, http.StatusAccepted, copied)
+}
+
+// GET /v1/requests/:request_id
+func (f *fakeUber) getRequest(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	f.mu.Lock()
+	ride, ok := f.rides[p.ByName("request_id")]
+	var copied fakeRide
+	if ok {
+		copied = *ride
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		writeFakeUberError(rw, http.StatusNotFound, "not_found", "Request not found.")
+		return
+	}
+	writeFakeUberJSON(rw, http.StatusOK, copied)
+}
+
+// DELETE /v1/requests/:request_id
+func (f *fakeUber) cancel(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	f.mu.Lock()
+	ride, ok := f.rides[p.ByName("request_id")]
+	completed := ok && ride.Status == "completed"
+	if ok && !completed {
+		ride.Status = "rider_canceled"
+	}
+	f.mu.Unlock()
+
+	switch {
+	case !ok:
+		writeFakeUberError(rw, http.StatusNotFound, "not_found", "Request not found.")
+	case completed:
+		writeFakeUberError(rw, http.StatusConflict, "invalid_status", "Request was completed.")
+	default:
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PUT /v1/sandbox/requests/:request_id
+func (f *fakeUber) updateSandbox(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+	var body PutRequestBody
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Status == "" {
+		writeFakeUberError(rw, http.StatusBadRequest, "invalid_request", "status is required.")
+		return
+	}
+	f.mu.Lock()
+	ride, ok := f.rides[p.ByName("request_id")]
+	cancelled := ok && ride.Status == "rider_canceled"
+	if ok && !cancelled {
+		ride.Status = body.Status
+	}
+	f.mu.Unlock()
+
+	switch {
+	case !ok:
+		writeFakeUberError(rw, http.StatusNotFound, "not_found", "Request not found.")
+	case cancelled:
+		writeFakeUberError(rw, http.StatusConflict, "invalid_status", "Request was canceled.")
+	default:
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeFakeUberJSON(rw http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// writeFakeUberError answers in the error format of the Uber API.
+func writeFakeUberError(rw http.ResponseWriter, status int, code, message string) {
+	writeFakeUberJSON(rw, status, map[string]string{"code": code, "message": message})
+}
+
+// runFakeUber serves the fake Uber API until the process is stopped. It
+// backs the "fake-uber" subcommand.
+func runFakeUber(args []string) error {
+	cfg := defaultFakeUberConfig()
+	fs := flag.NewFlagSet("manGo fake-uber", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to a YAML or JSON file with products, prices and failures")
+	listen := fs.String("listen", "", "address the fake Uber API listens on (default "+cfg.Listen+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, &cfg); err != nil {
+			return err
+		}
+	}
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	log.Printf("fake Uber API listening on %s", cfg.Listen)
+	return http.ListenAndServe(cfg.Listen, newFakeUber(cfg))
+}
+
+// Validate reports the first setting the fake Uber API cannot work with.
+func (cfg FakeUberConfig) Validate() error {
+	if cfg.AverageSpeedMph <= 0 {
+		return errors.New("fake-uber: average_speed_mph must be positive")
+	}
+	if len(cfg.Products) == 0 {
+		return errors.New("fake-uber: products needs at least one product")
+	}
+	for _, p := range cfg.Products {
+		if p.ProductId == "" {
+			return errors.New("fake-uber: products entries need a product_id")
+		}
+	}
+	if cfg.FailRate < 0 || cfg.FailRate > 1 {
+		return errors.New("fake-uber: fail_rate must be between 0 and 1")
+	}
+	if cfg.FailRate > 0 && (cfg.FailStatus < 400 || cfg.FailStatus > 599) {
+		return errors.New("fake-uber: fail_status must be an HTTP error status")
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrAddressNotFound is returned when a geocoder has no coordinates for an
+// address.
+var ErrAddressNotFound = errors.New("address not found")
+
+// Geocoder resolves a free-text address to coordinates. Implementations
+// give up once ctx is done.
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (LocationLatLng, error)
+}
+
+var geocoder Geocoder
+
+// googleMapsURL is the default base URL of the Google Maps API.
+const googleMapsURL = "http://maps.google.com"
+
+// googleGeocoder queries the Google Geocoding API.
+type googleGeocoder struct {
+	baseURL string
+	client  *upstreamClient
+}
+
+// newGoogleGeocoder makes client retry and count OVER_QUERY_LIMIT and
+// UNKNOWN_ERROR answers as failed calls, although Google sends them with
+// HTTP 200.
+func newGoogleGeocoder(baseURL string, client *upstreamClient) *googleGeocoder {
+	client.failedBody = googleFailed
+	return &googleGeocoder{baseURL: baseURL, client: client}
+}
+
+// googleFailed reports whether a geocode answer is a rate limit or a
+// server error, which may succeed when tried again.
+func googleFailed(body []byte) bool {
+	var answer struct {
+		Status string `json:"status"`
+	}
+	if json.Unmarshal(body, &answer) != nil {
+		return false
+	}
+	return answer.Status == "OVER_QUERY_LIMIT" || answer.Status == "UNKNOWN_ERROR"
+}
+
+func (g *googleGeocoder) Geocode(ctx context.Context, address string) (LocationLatLng, error) {
+	query := url.Values{}
+	query.Set("address", address)
+	query.Set("sensor", "false")
+
+	request, err := http.NewRequestWithContext(ctx, "GET", g.baseURL+"/maps/api/geocode/json?"+query.Encode(), nil)
+	if err != nil {
+		return LocationLatLng{}, err
+	}
+	resp, err := g.client.Do(request)
+	if err != nil {
+		return LocationLatLng{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return LocationLatLng{}, fmt.Errorf("google geocode: %s", resp.Status)
+	}
+
+	var body struct {
+		Status        string `json:"status"`
+		Error_message string `json:"error_message"`
+		Results       []struct {
+			Geometry struct {
+				Location LocationLatLng `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return LocationLatLng{}, fmt.Errorf("google geocode: %v", err)
+	}
+	switch body.Status {
+	case "OK", "ZERO_RESULTS":
+	default:
+		// OVER_QUERY_LIMIT, REQUEST_DENIED, INVALID_REQUEST or UNKNOWN_ERROR
+		if body.Error_message != "" {
+			return LocationLatLng{}, fmt.Errorf("google geocode: %s: %s", body.Status, body.Error_message)
+		}
+		return LocationLatLng{}, fmt.Errorf("google geocode: %s", body.Status)
+	}
+	if len(body.Results) == 0 {
+		return LocationLatLng{}, ErrAddressNotFound
+	}
+	return body.Results[0].Geometry.Location, nil
+}
+
+// GazetteerEntry is one known address in a gazetteer file.
+type GazetteerEntry struct {
+	Address string  `json:"address"`
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+}
+
+// gazetteerGeocoder resolves addresses from a local list of known places,
+// for environments without access to Google.
+//
+// Matching ignores case, punctuation and zip codes. A leading place name
+// such as "Facebook, " is skipped when the full address is unknown.
+type gazetteerGeocoder struct {
+	places map[string]LocationLatLng
+}
+
+// loadGazetteer reads a gazetteer from a .json file holding a list of
+// GazetteerEntry or a .csv file with address,lat,lng columns.
+func loadGazetteer(path string) (*gazetteerGeocoder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []GazetteerEntry
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.NewDecoder(f).Decode(&entries)
+	} else {
+		entries, err = readGazetteerCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gazetteer %s: %v", path, err)
+	}
+
+	g := &gazetteerGeocoder{places: make(map[string]LocationLatLng)}
+	for _, e := range entries {
+		g.places[normalizeAddress(e.Address)] = LocationLatLng{Lat: e.Lat, Lng: e.Lng}
+	}
+	return g, nil
+}
+
+func readGazetteerCSV(r io.Reader) ([]GazetteerEntry, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []GazetteerEntry
+	for i, rec := range records {
+		if len(rec) != 3 {
+			return nil, fmt.Errorf("line %d: want address,lat,lng", i+1)
+		}
+		if i == 0 && strings.EqualFold(rec[0], "address") {
+			continue
+		}
+		lat, err := strconv.ParseFloat(strings.TrimSpace(rec[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(rec[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		entries = append(entries, GazetteerEntry{Address: rec[0], Lat: lat, Lng: lng})
+	}
+	return entries, nil
+}
+
+func (g *gazetteerGeocoder) Geocode(ctx context.Context, address string) (LocationLatLng, error) {
+	if err := ctx.Err(); err != nil {
+		return LocationLatLng{}, err
+	}
+	for _, key := range addressKeys(address) {
+		if coord, ok := g.places[key]; ok {
+			return coord, nil
+		}
+	}
+	return LocationLatLng{}, ErrAddressNotFound
+}
+
+// addressKeys returns the normalized forms of address to look up, from the
+// full address to ever shorter ones with leading parts such as a place
+// name removed.
+func addressKeys(address string) []string {
+	parts := strings.Split(address, ",")
+	keys := make([]string, len(parts))
+	for i := range parts {
+		keys[i] = normalizeAddress(strings.Join(parts[i:], ","))
+	}
+	return keys
+}
+
+// normalizeAddress lowercases address, drops punctuation and zip codes and
+// collapses whitespace.
+func normalizeAddress(address string) string {
+	address = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, address)
+
+	words := strings.Fields(address)
+	if n := len(words); n > 1 && isZipCode(words[n-1]) {
+		words = words[:n-1]
+	}
+	return strings.Join(words, " ")
+}
+
+func isZipCode(word string) bool {
+	if len(word) != 5 {
+		return false
+	}
+	for _, r := range word {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
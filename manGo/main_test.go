@@ -0,0 +1,871 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testEnv is the service running against the memory store and the fake
+// Uber and Google APIs.
+type testEnv struct {
+	t      *testing.T
+	server *httptest.Server
+	uber   *fakeUber
+	// intercept, if set, sees every call to the fake Uber API before it is
+	// answered and may hold it up.
+	intercept func(req *http.Request)
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	fixtures, err := loadGeocodeFixtures(filepath.Join("testdata", "geocode.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	google := httptest.NewServer(newFakeGoogle(FakeGoogleConfig{Fixtures: fixtures}))
+	uber := newFakeUber(defaultFakeUberConfig())
+	env := &testEnv{t: t, uber: uber}
+	uberServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if env.intercept != nil {
+			env.intercept(req)
+		}
+		uber.ServeHTTP(rw, req)
+	}))
+
+	appConfig = defaultConfig()
+	appConfig.Store = "memory"
+	appConfig.Upstream.Backoff = Duration{time.Millisecond}
+	appConfig.Upstream.MaxBackoff = Duration{10 * time.Millisecond}
+	appConfig.Upstream.BreakerCooldown = Duration{100 * time.Millisecond}
+	store := newMemoryStore()
+	locationStore = store
+	tripStore = store
+	uberClient := newUpstreamClient("Uber", appConfig.Upstream)
+	priceEstimator = newUberEstimator(uberServer.URL, "test-server-token", uberClient)
+	estimateCache = nil
+	geocoder = newGoogleGeocoder(google.URL, newUpstreamClient("Google", appConfig.Upstream))
+	rideClient = newUberRides(uberServer.URL, "test-access-token", uberClient)
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		server.Close()
+		uberServer.Close()
+		google.Close()
+	})
+	env.server = server
+	return env
+}
+
+// do sends body as JSON, checks the response status and decodes the
+// response into out unless it is nil.
+func (e *testEnv) do(method, path string, body interface{}, wantStatus int, out interface{}) {
+	e.t.Helper()
+
+	status, data := e.send(method, path, body)
+	if status != wantStatus {
+		e.t.Fatalf("%s %s: status %d, want %d: %s", method, path, status, wantStatus, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			e.t.Fatalf("%s %s: %v: %s", method, path, err, data)
+		}
+	}
+}
+
+// send sends body as JSON and returns the response status and body.
+func (e *testEnv) send(method, path string, body interface{}) (int, []byte) {
+	e.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, e.server.URL+path, reader)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// expectError sends the request and checks the status and error code.
+func (e *testEnv) expectError(method, path string, body interface{}, wantStatus int, wantCode string) {
+	e.t.Helper()
+
+	var apiErr APIError
+	e.do(method, path, body, wantStatus, &apiErr)
+	if apiErr.Code != wantCode {
+		e.t.Fatalf("%s %s: code %q, want %q", method, path, apiErr.Code, wantCode)
+	}
+}
+
+// setMetered makes the fake Uber API answer with or without a price for
+// the products.
+func (e *testEnv) setMetered(metered bool, productIds ...string) {
+	for _, id := range productIds {
+		product := e.uber.products[id]
+		product.Metered = metered
+		e.uber.products[id] = product
+	}
+}
+
+// createLocations stores locs and returns their ids.
+func (e *testEnv) createLocations(locs ...LocationRequest) []string {
+	e.t.Helper()
+
+	var ids []string
+	for _, loc := range locs {
+		var locResp LocationResponse
+		e.do("POST", "/locations", loc, http.StatusOK, &locResp)
+		ids = append(ids, strconv.FormatInt(locResp.Id, 10))
+	}
+	return ids
+}
+
+var (
+	mainSt       = LocationRequest{Name: "John Smith", Address: "123 Main St", City: "San Francisco", State: "CA", Zip: "94113"}
+	masonSt      = LocationRequest{Address: "950 Mason St", City: "San Francisco", State: "CA", Zip: "94108"}
+	hackerWay    = LocationRequest{Name: "Facebook", Address: "1 Hacker Way", City: "Menlo Park", State: "CA", Zip: "94025"}
+	amphitheatre = LocationRequest{Name: "Google", Address: "1600 Amphitheatre Pkwy", City: "Mountain View", State: "CA", Zip: "94043"}
+	sanFernando  = LocationRequest{Name: "SJSU", Address: "150 E San Fernando St", City: "San Jose", State: "CA", Zip: "95112"}
+	firstAve     = LocationRequest{Name: "Yahoo", Address: "701 1st Ave", City: "Sunnyvale", State: "CA", Zip: "94089"}
+	coastAve     = LocationRequest{Name: "Intuit", Address: "2675 Coast Ave", City: "Mountain View", State: "CA", Zip: "94043"}
+)
+
+func TestLocations(t *testing.T) {
+	env := newTestEnv(t)
+
+	var created LocationResponse
+	env.do("POST", "/locations", mainSt, http.StatusOK, &created)
+	want := LocationResponse{
+		Id:         firstLocationId,
+		Name:       "John Smith",
+		Address:    "123 Main St",
+		City:       "San Francisco",
+		State:      "CA",
+		Zip:        "94113",
+		Coordinate: LocationLatLng{Lat: 37.7917618, Lng: -122.3943405},
+	}
+	if created != want {
+		t.Fatalf("POST /locations = %+v, want %+v", created, want)
+	}
+
+	var got LocationResponse
+	env.do("GET", "/locations/12345", nil, http.StatusOK, &got)
+	if got != want {
+		t.Fatalf("GET /locations/12345 = %+v, want %+v", got, want)
+	}
+
+	env.do("PUT", "/locations/12345", masonSt, http.StatusOK, &got)
+	want.Address = "950 Mason St"
+	want.Zip = "94108"
+	want.Coordinate = LocationLatLng{Lat: 37.7923, Lng: -122.4101}
+	if got != want {
+		t.Fatalf("PUT /locations/12345 = %+v, want %+v", got, want)
+	}
+
+	var deleted DeleteResponse
+	env.do("DELETE", "/locations/12345", nil, http.StatusOK, &deleted)
+	if deleted.Id != 12345 {
+		t.Fatalf("DELETE /locations/12345 = %+v", deleted)
+	}
+	env.expectError("GET", "/locations/12345", nil, http.StatusNotFound, "location_not_found")
+	env.expectError("DELETE", "/locations/12345", nil, http.StatusNotFound, "location_not_found")
+	env.expectError("PUT", "/locations/12345", masonSt, http.StatusNotFound, "location_not_found")
+	env.expectError("GET", "/locations/abc", nil, http.StatusBadRequest, "invalid_id")
+
+	env.expectError("POST", "/locations", LocationRequest{Address: "1 Nowhere Rd", City: "Atlantis", State: "CA"}, http.StatusBadRequest, "address_not_found")
+	env.expectError("POST", "/locations", LocationRequest{Address: "1 Over Limit Ave", City: "Nowhere", State: "CA"}, http.StatusBadGateway, "upstream_error")
+
+	// Ids are never reused
+	env.do("POST", "/locations", mainSt, http.StatusOK, &created)
+	if created.Id != firstLocationId+1 {
+		t.Fatalf("POST /locations after delete: id %d, want %d", created.Id, firstLocationId+1)
+	}
+}
+
+func TestResponsesKeepUserText(t *testing.T) {
+	env := newTestEnv(t)
+	loc := hackerWay
+	loc.Name = "100% Fun"
+	ids := env.createLocations(mainSt, loc)
+
+	resp, err := http.Get(env.server.URL + "/locations/" + ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got LocationResponse
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if got.Name != loc.Name || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Name %q, Content-Type %q", got.Name, resp.Header.Get("Content-Type"))
+	}
+
+	var trip Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"stops":                     []map[string]interface{}{{"address": "100% Fun, 1 Hacker Way, Menlo Park, CA"}},
+	}, http.StatusOK, &trip)
+	if len(trip.Adhoc_stops) != 1 || trip.Adhoc_stops[0].Address != "100% Fun, 1 Hacker Way, Menlo Park, CA" {
+		t.Fatalf("Adhoc_stops = %+v", trip.Adhoc_stops)
+	}
+}
+
+// plannedRoute is the part of a trip compared against the golden files.
+type plannedRoute struct {
+	Best_route_location_ids []string
+	Legs                    []TripLeg
+	Adhoc_stops             []AdhocStop
+	Total_uber_costs        float64
+	Total_uber_duration     float64
+	Total_distance          float64
+	Algorithm               string
+	Objective               string
+}
+
+func TestPlanTrip(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt, hackerWay, amphitheatre, sanFernando, firstAve, coastAve)
+	home, stops := ids[0], ids[1:6]
+
+	tests := []struct {
+		name string
+		req  map[string]interface{}
+	}{
+		{"round_trip", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              stops,
+		}},
+		{"one_way", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              stops,
+			"round_trip":                false,
+		}},
+		{"ending_location", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              stops,
+			"ending_location_id":        ids[6],
+		}},
+		{"duration_objective", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              stops,
+			"objective":                 "duration",
+		}},
+		{"greedy_local_search", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              append(append(append([]string{}, stops...), stops...), stops...),
+			"objective":                 "distance",
+		}},
+		{"adhoc_stops", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              stops[:2],
+			"stops": []map[string]interface{}{
+				{"lat": 37.8199, "lng": -122.4783},
+				{"address": "1 Hacker Way, Menlo Park, CA"},
+			},
+		}},
+		{"duplicate_stops", map[string]interface{}{
+			"starting_from_location_id": home,
+			"location_ids":              []string{stops[0], stops[0], stops[2], home},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env.t = t
+
+			var planned Trip
+			env.do("POST", "/trips", tt.req, http.StatusOK, &planned)
+			if planned.Status != statusPlanning {
+				t.Errorf("Status = %q, want %q", planned.Status, statusPlanning)
+			}
+
+			var fetched Trip
+			env.do("GET", "/trips/"+strconv.FormatInt(planned.Id, 10), nil, http.StatusOK, &fetched)
+			if !reflect.DeepEqual(fetched, planned) {
+				t.Errorf("GET /trips/%d = %+v, want %+v", planned.Id, fetched, planned)
+			}
+
+			assertGolden(t, tt.name, plannedRoute{
+				Best_route_location_ids: planned.Best_route_location_ids,
+				Legs:                    planned.Legs,
+				Adhoc_stops:             planned.Adhoc_stops,
+				Total_uber_costs:        planned.Total_uber_costs,
+				Total_uber_duration:     planned.Total_uber_duration,
+				Total_distance:          planned.Total_distance,
+				Algorithm:               planned.Algorithm,
+				Objective:               planned.Objective,
+			})
+		})
+	}
+}
+
+func TestPlanTripErrors(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt)
+
+	env.expectError("POST", "/trips", "not a trip", http.StatusBadRequest, "invalid_body")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              []string{"99999"},
+	}, http.StatusNotFound, "location_not_found")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              []string{"abc"},
+	}, http.StatusBadRequest, "invalid_id")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+		"objective":                 "scenery",
+	}, http.StatusBadRequest, "invalid_objective")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"stops":                     []map[string]interface{}{{"lat": 37.8}},
+	}, http.StatusBadRequest, "invalid_stop")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"location_ids": ids,
+	}, http.StatusBadRequest, "invalid_trip")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+	}, http.StatusBadRequest, "invalid_trip")
+	env.expectError("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"round_trip":                false,
+	}, http.StatusBadRequest, "invalid_trip")
+	env.expectError("GET", "/trips/1", nil, http.StatusNotFound, "trip_not_found")
+	env.expectError("GET", "/no/such/route", nil, http.StatusNotFound, "route_not_found")
+}
+
+func TestCacheStats(t *testing.T) {
+	env := newTestEnv(t)
+	estimateCache = newCachingEstimator(priceEstimator, newLRUCache(100, time.Minute), 4)
+	priceEstimator = estimateCache
+	ids := env.createLocations(mainSt, masonSt, hackerWay)
+	trip := map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}
+
+	// The second plan of the same trip is served from the cache
+	var first, second CacheStats
+	env.do("POST", "/trips", trip, http.StatusOK, nil)
+	env.do("GET", "/cache/stats", nil, http.StatusOK, &first)
+	env.do("POST", "/trips", trip, http.StatusOK, nil)
+	env.do("GET", "/cache/stats", nil, http.StatusOK, &second)
+	if first.Hits != 0 || first.Misses != 6 || second.Hits != 6 || second.Misses != 6 {
+		t.Fatalf("stats %+v after the first plan and %+v after the second, want 6 misses, then 6 hits", first, second)
+	}
+}
+
+func TestPlanTripUnpricedProducts(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt, hackerWay)
+	trip := map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}
+
+	// A metered product is listed on every leg but never chosen, even
+	// though it would be the cheapest
+	env.setMetered(true, "offline-uberx")
+	var planned Trip
+	env.do("POST", "/trips", trip, http.StatusOK, &planned)
+	for _, leg := range planned.Legs {
+		if leg.Product_id == "offline-uberx" || len(leg.Unpriced_products) != 1 || leg.Unpriced_products[0].Product_id != "offline-uberx" {
+			t.Fatalf("leg %s -> %s: Product_id %q, Unpriced_products %v", leg.From_location_id, leg.To_location_id, leg.Product_id, leg.Unpriced_products)
+		}
+	}
+
+	// Without any priced product no stop can be reached
+	env.setMetered(true, "offline-uberxl", "offline-uberblack")
+	var apiErr APIError
+	env.do("POST", "/trips", trip, http.StatusUnprocessableEntity, &apiErr)
+	if apiErr.Code != "unreachable_stop" {
+		t.Fatalf("code %q, want unreachable_stop", apiErr.Code)
+	}
+	stops := apiErr.Details.(map[string]interface{})["stops"].([]interface{})
+	if len(stops) != 3 {
+		t.Fatalf("%d unreachable stops, want 3: %v", len(stops), stops)
+	}
+	for _, stop := range stops {
+		if reason := stop.(map[string]interface{})["reason"]; reason != reasonUnpriced {
+			t.Fatalf("reason %v, want %s", reason, reasonUnpriced)
+		}
+	}
+
+	// A planned trip fails once its next ride cannot be priced
+	env.setMetered(false, "offline-uberx", "offline-uberxl", "offline-uberblack")
+	env.do("POST", "/trips", trip, http.StatusOK, &planned)
+	env.setMetered(true, "offline-uberx", "offline-uberxl", "offline-uberblack")
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10)
+	env.expectError("PUT", path+"/request", nil, http.StatusUnprocessableEntity, "no_priced_product")
+	var failed Trip
+	env.do("GET", path, nil, http.StatusOK, &failed)
+	if failed.Status != statusFailed {
+		t.Fatalf("Status = %q, want %q", failed.Status, statusFailed)
+	}
+}
+
+func TestRequestTrip(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt, hackerWay, amphitheatre)
+
+	var planned Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}, http.StatusOK, &planned)
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10) + "/request"
+	route := planned.Best_route_location_ids
+
+	// One ride to every stop, then one back to the start
+	for leg := 0; leg <= len(route); leg++ {
+		var trip Trip
+		env.do("PUT", path, nil, http.StatusOK, &trip)
+
+		wantStatus, wantNext := statusArrivedAtStop, ids[0]
+		if leg < len(route) {
+			wantNext = route[leg]
+		} else {
+			wantStatus = statusCompleted
+		}
+		if trip.Status != wantStatus || trip.Next_destination_location_id != wantNext || trip.Completed_legs != leg+1 {
+			t.Fatalf("leg %d: Status %q, Next_destination_location_id %q, Completed_legs %d, want %q, %q, %d",
+				leg, trip.Status, trip.Next_destination_location_id, trip.Completed_legs, wantStatus, wantNext, leg+1)
+		}
+		if trip.Uber_request_id == "" || trip.Uber_wait_time_eta != 5 {
+			t.Fatalf("leg %d: Uber_request_id %q, Uber_wait_time_eta %v", leg, trip.Uber_request_id, trip.Uber_wait_time_eta)
+		}
+	}
+
+	var trip Trip
+	env.do("GET", "/trips/"+strconv.FormatInt(planned.Id, 10), nil, http.StatusOK, &trip)
+	var statuses []string
+	for _, change := range trip.Status_history {
+		statuses = append(statuses, change.Status)
+	}
+	want := []string{statusPlanning}
+	for range route {
+		want = append(want, statusRequesting, statusInProgress, statusArrivedAtStop)
+	}
+	want = append(want, statusReturning, statusCompleted)
+	if !reflect.DeepEqual(statuses, want) {
+		t.Fatalf("Status_history = %v, want %v", statuses, want)
+	}
+
+	for id, ride := range env.uber.rides {
+		if ride.Status != "completed" {
+			t.Errorf("ride %s: status %q, want completed", id, ride.Status)
+		}
+	}
+	if len(env.uber.rides) != len(route)+1 {
+		t.Errorf("%d rides booked, want %d", len(env.uber.rides), len(route)+1)
+	}
+
+	env.expectError("PUT", path, nil, http.StatusConflict, "invalid_transition")
+}
+
+func TestRequestTripBooksPlannedProduct(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, hackerWay)
+
+	var planned Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}, http.StatusOK, &planned)
+
+	// A surge after planning makes another product cheaper, but the ride
+	// is booked on the product the trip was planned with
+	product := env.uber.products[planned.Legs[0].Product_id]
+	product.Surge = 5
+	env.uber.products[product.ProductId] = product
+
+	var trip Trip
+	env.do("PUT", "/trips/"+strconv.FormatInt(planned.Id, 10)+"/request", nil, http.StatusOK, &trip)
+	if booked := env.uber.rides[trip.Uber_request_id].Product_id; booked != planned.Legs[0].Product_id {
+		t.Fatalf("booked %q, planned %q", booked, planned.Legs[0].Product_id)
+	}
+
+	// Once the planned product is gone another one is picked with the
+	// weights the trip was planned with, here preferring a quicker ride
+	// to a cheaper one
+	product.Surge = 0
+	env.uber.products[product.ProductId] = product
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+		"objective":                 "weighted",
+		"weights":                   ObjectiveWeights{Cost: 1, Duration: 1},
+	}, http.StatusOK, &planned)
+	if planned.Legs[0].Product_id != "offline-uberx" {
+		t.Fatalf("planned %q, want offline-uberx", planned.Legs[0].Product_id)
+	}
+	env.setMetered(true, "offline-uberx")
+	product = env.uber.products["offline-uberxl"]
+	product.Delay = 600
+	env.uber.products[product.ProductId] = product
+
+	env.do("PUT", "/trips/"+strconv.FormatInt(planned.Id, 10)+"/request", nil, http.StatusOK, &trip)
+	if booked := env.uber.rides[trip.Uber_request_id].Product_id; booked != "offline-uberblack" {
+		t.Fatalf("booked %q, want offline-uberblack", booked)
+	}
+}
+
+func TestRequestTripUpstreamFailure(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt)
+
+	var planned Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}, http.StatusOK, &planned)
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10)
+
+	env.uber.cfg.FailRate = 1
+	env.uber.cfg.FailEndpoints = []string{fakeUberRequests}
+	env.expectError("PUT", path+"/request", nil, http.StatusBadGateway, "upstream_error")
+
+	var trip Trip
+	env.do("GET", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusFailed || trip.Completed_legs != 0 {
+		t.Fatalf("after failure: Status %q, Completed_legs %d, want %q, 0", trip.Status, trip.Completed_legs, statusFailed)
+	}
+
+	// The same leg is requested again once Uber recovers
+	env.uber.cfg.FailRate = 0
+	env.do("PUT", path+"/request", nil, http.StatusOK, &trip)
+	if trip.Status != statusArrivedAtStop || trip.Next_destination_location_id != ids[1] {
+		t.Fatalf("after retry: Status %q, Next_destination_location_id %q", trip.Status, trip.Next_destination_location_id)
+	}
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt)
+	trip := map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}
+	var planned Trip
+	env.do("POST", "/trips", trip, http.StatusOK, &planned)
+
+	// Failed estimates are retried and reported, until enough calls have
+	// failed in a row that further ones are refused without calling Uber
+	env.uber.cfg.FailRate = 1
+	env.uber.cfg.FailEndpoints = []string{fakeUberEstimates}
+	open := false
+	for i := 0; i <= appConfig.Upstream.BreakerThreshold && !open; i++ {
+		status, data := env.send("POST", "/trips", trip)
+		switch status {
+		case http.StatusBadGateway:
+		case http.StatusServiceUnavailable:
+			var apiErr APIError
+			json.Unmarshal(data, &apiErr)
+			open = apiErr.Code == "upstream_unavailable"
+		default:
+			t.Fatalf("trip %d: status %d: %s", i, status, data)
+		}
+	}
+	if !open {
+		t.Fatalf("circuit breaker did not open after %d failed trips", appConfig.Upstream.BreakerThreshold+1)
+	}
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10) + "/request"
+	env.expectError("PUT", path, nil, http.StatusServiceUnavailable, "upstream_unavailable")
+
+	// Once the cooldown is over a single trial call closes the breaker
+	// again; the ride is requested one call at a time
+	env.uber.cfg.FailRate = 0
+	time.Sleep(appConfig.Upstream.BreakerCooldown.Duration)
+	env.do("PUT", path, nil, http.StatusOK, nil)
+	env.do("POST", "/trips", trip, http.StatusOK, nil)
+}
+
+func TestGeocodeCancelledWithRequest(t *testing.T) {
+	env := newTestEnv(t)
+	cancelled := make(chan struct{}, 1)
+	google := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer google.Close()
+	geocoder = newGoogleGeocoder(google.URL, newUpstreamClient("Google", appConfig.Upstream))
+
+	// The client gives up long before the geocoder would time out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	body, _ := json.Marshal(mainSt)
+	req, _ := http.NewRequestWithContext(ctx, "POST", env.server.URL+"/locations", bytes.NewReader(body))
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("POST /locations answered %s", resp.Status)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("geocode not cancelled with the request")
+	}
+}
+
+func TestGeocoderRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	overLimit := LocationRequest{Address: "1 Over Limit Ave", City: "Nowhere", State: "CA"}
+
+	// OVER_QUERY_LIMIT comes with HTTP 200 but still counts as a failed
+	// call, so that the breaker opens before Google is asked again
+	for i := 0; i < appConfig.Upstream.BreakerThreshold; i++ {
+		env.expectError("POST", "/locations", overLimit, http.StatusBadGateway, "upstream_error")
+	}
+	env.expectError("POST", "/locations", mainSt, http.StatusServiceUnavailable, "upstream_unavailable")
+
+	time.Sleep(appConfig.Upstream.BreakerCooldown.Duration)
+	env.do("POST", "/locations", mainSt, http.StatusOK, nil)
+}
+
+func TestRequestTripAfterLostSave(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt)
+
+	// stuckTrip plans a trip and completes its first ride, but leaves the
+	// trip stored as if saving it had failed afterwards: still under way
+	// with the id of the completed ride
+	stuckTrip := func() (string, Trip) {
+		var planned, trip Trip
+		env.do("POST", "/trips", map[string]interface{}{
+			"starting_from_location_id": ids[0],
+			"location_ids":              ids[1:],
+		}, http.StatusOK, &planned)
+		path := "/trips/" + strconv.FormatInt(planned.Id, 10)
+		env.do("PUT", path+"/request", nil, http.StatusOK, &trip)
+
+		trip.Status = statusInProgress
+		trip.Status_history = trip.Status_history[:len(trip.Status_history)-1]
+		trip.Completed_legs = 0
+		if err := tripStore.SaveTrip(trip, statusArrivedAtStop); err != nil {
+			t.Fatal(err)
+		}
+		return path, trip
+	}
+
+	// The next PUT finishes the leg of the completed ride without booking
+	// another one
+	path, stuck := stuckTrip()
+	var trip Trip
+	env.do("PUT", path+"/request", nil, http.StatusOK, &trip)
+	if trip.Status != statusArrivedAtStop || trip.Completed_legs != 1 || trip.Uber_request_id != stuck.Uber_request_id {
+		t.Fatalf("after PUT: Status %q, Completed_legs %d, Uber_request_id %q", trip.Status, trip.Completed_legs, trip.Uber_request_id)
+	}
+	if len(env.uber.rides) != 1 {
+		t.Fatalf("%d rides booked, want 1", len(env.uber.rides))
+	}
+	env.do("PUT", path+"/request", nil, http.StatusOK, &trip)
+	if trip.Status != statusCompleted {
+		t.Fatalf("after the last PUT: Status %q, want %q", trip.Status, statusCompleted)
+	}
+
+	// Cancelling does not need the completed ride to be cancelled
+	path, stuck = stuckTrip()
+	env.do("DELETE", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusCancelled || env.uber.rides[stuck.Uber_request_id].Status != "completed" {
+		t.Fatalf("after DELETE: Status %q, ride %q", trip.Status, env.uber.rides[stuck.Uber_request_id].Status)
+	}
+}
+
+func TestRequestTripCompleteFailure(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt)
+
+	var planned Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}, http.StatusOK, &planned)
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10)
+	rideStatus := func(id string) string {
+		env.uber.mu.Lock()
+		defer env.uber.mu.Unlock()
+		return env.uber.rides[id].Status
+	}
+
+	// A ride that cannot be completed is cancelled
+	env.uber.cfg.FailRate = 1
+	env.uber.cfg.FailEndpoints = []string{fakeUberSandbox}
+	env.expectError("PUT", path+"/request", nil, http.StatusBadGateway, "upstream_error")
+	var trip Trip
+	env.do("GET", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusFailed || trip.Uber_request_id != "" || rideStatus("fake-1") != "rider_canceled" {
+		t.Fatalf("Status %q, Uber_request_id %q, ride %q", trip.Status, trip.Uber_request_id, rideStatus("fake-1"))
+	}
+
+	// If cancelling fails too, the ride stays on the trip and is cancelled
+	// before the leg is booked again
+	env.uber.cfg.FailEndpoints = []string{fakeUberSandbox, fakeUberCancel}
+	env.expectError("PUT", path+"/request", nil, http.StatusBadGateway, "upstream_error")
+	env.do("GET", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusFailed || trip.Uber_request_id != "fake-2" || rideStatus("fake-2") != "processing" {
+		t.Fatalf("Status %q, Uber_request_id %q, ride %q", trip.Status, trip.Uber_request_id, rideStatus("fake-2"))
+	}
+	env.uber.cfg.FailRate = 0
+	env.do("PUT", path+"/request", nil, http.StatusOK, &trip)
+	if trip.Uber_request_id != "fake-3" || rideStatus("fake-2") != "rider_canceled" || rideStatus("fake-3") != "completed" {
+		t.Fatalf("Uber_request_id %q, rides %q and %q", trip.Uber_request_id, rideStatus("fake-2"), rideStatus("fake-3"))
+	}
+
+	// Cancelling a failed trip cancels its open ride
+	env.uber.cfg.FailRate = 1
+	env.expectError("PUT", path+"/request", nil, http.StatusBadGateway, "upstream_error")
+	env.uber.cfg.FailRate = 0
+	env.do("DELETE", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusCancelled || rideStatus("fake-4") != "rider_canceled" {
+		t.Fatalf("Status %q, ride %q", trip.Status, rideStatus("fake-4"))
+	}
+}
+
+func TestCancelTripWithOutstandingRide(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt)
+
+	var planned Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}, http.StatusOK, &planned)
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10)
+
+	// Hold the ride under way until the trip has been cancelled
+	release := make(chan struct{})
+	env.intercept = func(req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/v1/sandbox/") {
+			<-release
+		}
+	}
+	putStatus := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("PUT", env.server.URL+path+"/request", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			putStatus <- 0
+			return
+		}
+		resp.Body.Close()
+		putStatus <- resp.StatusCode
+	}()
+
+	var trip Trip
+	for deadline := time.Now().Add(5 * time.Second); trip.Status != statusInProgress; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("ride not under way, trip is %q", trip.Status)
+		}
+		env.do("GET", path, nil, http.StatusOK, &trip)
+	}
+	rideId := trip.Uber_request_id
+
+	env.do("DELETE", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusCancelled {
+		t.Fatalf("Status = %q, want %q", trip.Status, statusCancelled)
+	}
+	env.uber.mu.Lock()
+	rideStatus := env.uber.rides[rideId].Status
+	env.uber.mu.Unlock()
+	if rideStatus != "rider_canceled" {
+		t.Fatalf("ride %s: status %q, want rider_canceled", rideId, rideStatus)
+	}
+
+	// The request still in flight must not undo the cancellation
+	close(release)
+	if status := <-putStatus; status != http.StatusConflict {
+		t.Fatalf("PUT in flight: status %d, want %d", status, http.StatusConflict)
+	}
+	env.do("GET", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusCancelled || trip.Completed_legs != 0 {
+		t.Fatalf("after PUT: Status %q, Completed_legs %d", trip.Status, trip.Completed_legs)
+	}
+}
+
+func TestCancelTrip(t *testing.T) {
+	env := newTestEnv(t)
+	ids := env.createLocations(mainSt, masonSt, hackerWay)
+
+	var planned Trip
+	env.do("POST", "/trips", map[string]interface{}{
+		"starting_from_location_id": ids[0],
+		"location_ids":              ids[1:],
+	}, http.StatusOK, &planned)
+	path := "/trips/" + strconv.FormatInt(planned.Id, 10)
+
+	env.do("PUT", path+"/request", nil, http.StatusOK, nil)
+
+	var trip Trip
+	env.do("DELETE", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusCancelled {
+		t.Fatalf("Status = %q, want %q", trip.Status, statusCancelled)
+	}
+	env.do("GET", path, nil, http.StatusOK, &trip)
+	if trip.Status != statusCancelled {
+		t.Fatalf("GET after cancel: Status = %q, want %q", trip.Status, statusCancelled)
+	}
+
+	env.expectError("PUT", path+"/request", nil, http.StatusConflict, "invalid_transition")
+	env.expectError("POST", path+"/cancel", nil, http.StatusConflict, "invalid_transition")
+	env.expectError("DELETE", "/trips/1", nil, http.StatusNotFound, "trip_not_found")
+}
+
+// assertGolden compares got, as indented JSON, with testdata/name.golden.
+// Run the tests with -update to rewrite the file.
+func assertGolden(t *testing.T, name string, got interface{}) {
+	t.Helper()
+
+	data, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run the tests with -update to create it", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("%s does not match:\ngot:\n%s\nwant:\n%s", path, data, want)
+	}
+}
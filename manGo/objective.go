@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Optimization objectives accepted in TripRequest.Objective.
+const (
+	objectiveCost     = "cost"
+	objectiveDuration = "duration"
+	objectiveDistance = "distance"
+	objectiveWeighted = "weighted"
+)
+
+// ObjectiveWeights blend the per-leg cost (in currency units), duration
+// (in seconds) and distance (in miles) into a single score.
+type ObjectiveWeights struct {
+	Cost     float64
+	Duration float64
+	Distance float64
+}
+
+// Objective is what the route planner minimizes. Each leg is scored as the
+// weighted sum of its cost, duration and distance.
+type Objective struct {
+	Name    string
+	Weights ObjectiveWeights
+}
+
+// parseObjective resolves the objective named in a trip request. An empty
+// name plans the cheapest route. Weights are only used by "weighted".
+func parseObjective(name string, weights ObjectiveWeights) (Objective, error) {
+	switch name {
+	case "", objectiveCost:
+		return Objective{Name: objectiveCost, Weights: ObjectiveWeights{Cost: 1}}, nil
+	case objectiveDuration:
+		return Objective{Name: objectiveDuration, Weights: ObjectiveWeights{Duration: 1}}, nil
+	case objectiveDistance:
+		return Objective{Name: objectiveDistance, Weights: ObjectiveWeights{Distance: 1}}, nil
+	case objectiveWeighted:
+		if weights.Cost < 0 || weights.Duration < 0 || weights.Distance < 0 {
+			return Objective{}, errors.New("objective weights must not be negative")
+		}
+		if weights.Cost == 0 && weights.Duration == 0 && weights.Distance == 0 {
+			return Objective{}, errors.New("weighted objective needs at least one non-zero weight")
+		}
+		return Objective{Name: objectiveWeighted, Weights: weights}, nil
+	}
+	return Objective{}, fmt.Errorf("unknown objective %q, want cost, duration, distance or weighted", name)
+}
+
+// score rates a priced product estimate; lower is better.
+func (o Objective) score(e ProductEstimate) float64 {
+	return o.Weights.Cost*e.cost() + o.Weights.Duration*e.Duration + o.Weights.Distance*e.Distance
+}
+
+// bestEstimate returns the priced product with the lowest score, preferring
+// the cheaper one on equal score. ok is false if no product is priced.
+func (o Objective) bestEstimate(estimates []ProductEstimate) (best ProductEstimate, ok bool) {
+	var bestScore float64
+	for _, e := range estimates {
+		if !e.priced() {
+			continue
+		}
+		s := o.score(e)
+		if !ok || s < bestScore || (s == bestScore && e.cost() < best.cost()) {
+			best = e
+			bestScore = s
+			ok = true
+		}
+	}
+	return best, ok
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Route planning algorithms reported in Trip.Algorithm.
+const (
+	algorithmHeldKarp = "held-karp"
+	algorithmGreedy   = "greedy"
+)
+
+// openEnd is the route end of a one-way trip that finishes at its last
+// stop.
+const openEnd = -1
+
+// exactSolverMaxStops is the largest number of stops, not counting the
+// starting location, that is solved exactly. Held-Karp needs
+// O(2^n * n^2) time and O(2^n * n) memory, which stays well below a
+// second up to here.
+const exactSolverMaxStops = 12
+
+// legEstimate is the best product for a ride between two points under
+// the trip's objective.
+type legEstimate struct {
+	Product_id    string
+	Display_name  string
+	Cost          float64
+	High_estimate float64
+	Distance      float64
+	Duration      float64
+	// Score is the objective value of the leg that the planner minimizes.
+	Score float64
+	// Unreachable is why no product can be booked for the ride; Cost,
+	// Duration and Score are then infinite. It is empty for usable legs.
+	Unreachable string
+	// Unpriced lists the available products without an upfront price.
+	// They are never chosen for a leg.
+	Unpriced []UnpricedProduct
+}
+
+// Reasons recorded in legEstimate.Unreachable.
+const (
+	reasonNoProducts = "no_products"
+	reasonUnpriced   = "only_unpriced_products"
+)
+
+// unreachableLeg is a ride no product can be booked for.
+func unreachableLeg(reason string, unpriced []UnpricedProduct) legEstimate {
+	inf := math.Inf(1)
+	return legEstimate{Cost: inf, Duration: inf, Score: inf, Unreachable: reason, Unpriced: unpriced}
+}
+
+// matrixOptions bounds the upstream calls made by buildLegMatrix.
+type matrixOptions struct {
+	// Workers is the number of estimates fetched at the same time.
+	Workers int
+	// Timeout limits each individual estimate call.
+	Timeout time.Duration
+}
+
+// buildLegMatrix prices the ride between every ordered pair of points.
+// legs[i][j] is the best ride from points[i] to points[j] under objective;
+// the diagonal is left empty. Rides without a priced product are
+// unreachable legs rather than errors.
+//
+// The pairs are fetched concurrently by opts.Workers goroutines. The first
+// failure, or ctx being cancelled, stops all outstanding calls. Points at
+// the same coordinates, such as a stop requested twice, are joined by an
+// empty leg that needs no ride and is not priced.
+func buildLegMatrix(ctx context.Context, estimator PriceEstimator, points []LocationLatLng, objective Objective, opts matrixOptions) ([][]legEstimate, error) {
+	legs := make([][]legEstimate, len(points))
+	for i := range legs {
+		legs[i] = make([]legEstimate, len(points))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type pair struct{ from, to int }
+	pairs := make(chan pair)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pairs {
+				leg, err := estimateLeg(ctx, estimator, points[p.from], points[p.to], objective, opts.Timeout)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				// Every pair is written by exactly one worker.
+				legs[p.from][p.to] = leg
+			}
+		}()
+	}
+
+send:
+	for i := range points {
+		for j := range points {
+			if i == j || points[i] == points[j] {
+				continue
+			}
+			select {
+			case pairs <- pair{i, j}:
+			case <-ctx.Done():
+				break send
+			}
+		}
+	}
+	close(pairs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return legs, nil
+}
+
+// estimateLeg fetches the estimates for one ride and picks the best product
+// for objective. The leg is unreachable if no product has a price.
+func estimateLeg(ctx context.Context, estimator PriceEstimator, from, to LocationLatLng, objective Objective, timeout time.Duration) (legEstimate, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	estimates, err := estimator.Estimate(ctx, from, to)
+	if err != nil {
+		return legEstimate{}, err
+	}
+	unpriced := unpricedProducts(estimates)
+	best, ok := objective.bestEstimate(estimates)
+	if !ok {
+		if len(unpriced) > 0 {
+			return unreachableLeg(reasonUnpriced, unpriced), nil
+		}
+		return unreachableLeg(reasonNoProducts, nil), nil
+	}
+	leg := legEstimate{
+		Product_id:   best.Product_id,
+		Display_name: best.Display_name,
+		Cost:         best.cost(),
+		Distance:     best.Distance,
+		Duration:     best.Duration,
+		Score:        objective.score(best),
+		Unpriced:     unpriced,
+	}
+	if best.High_estimate != nil {
+		leg.High_estimate = *best.High_estimate
+	}
+	return leg, nil
+}
+
+// planRoute orders the stops of legs into the lowest scoring route from
+// point 0 to end. end is 0 for a round trip, the index of a fixed ending
+// point, or openEnd to finish at whichever stop is cheapest; every other
+// point is a stop. It returns the visiting order and the algorithm used to
+// find it. Routes too large to solve exactly are built greedily and then
+// improved by local search within budget.
+func planRoute(legs [][]legEstimate, end int, budget improvementBudget) ([]int, string) {
+	if len(routeStops(legs, end)) <= exactSolverMaxStops {
+		return heldKarp(legs, end), algorithmHeldKarp
+	}
+	order := nearestNeighbour(legs, end)
+	if budget.Passes <= 0 {
+		return order, algorithmGreedy
+	}
+	return improveRoute(legs, order, end, budget), algorithmLocalSearch
+}
+
+// checkRoute verifies that order visits every stop between point 0 and
+// end exactly once. It returns the stops that are missing and those that
+// are visited more than once.
+func checkRoute(legs [][]legEstimate, order []int, end int) (missing, repeated []int) {
+	visits := make([]int, len(legs))
+	for _, stop := range order {
+		if stop <= 0 || stop >= len(legs) || stop == end {
+			repeated = append(repeated, stop)
+			continue
+		}
+		visits[stop]++
+		if visits[stop] == 2 {
+			repeated = append(repeated, stop)
+		}
+	}
+	for _, stop := range routeStops(legs, end) {
+		if visits[stop] == 0 {
+			missing = append(missing, stop)
+		}
+	}
+	return missing, repeated
+}
+
+// unreachableStops returns the points of the route that no other point it
+// could be reached from has a usable leg to: a stop from the start or
+// another stop, the end from any stop. Such a point cannot be on any
+// route.
+func unreachableStops(legs [][]legEstimate, end int) []int {
+	stops := routeStops(legs, end)
+	targets := stops
+	if end != openEnd && (len(stops) > 0 || end != 0) {
+		targets = append(append([]int(nil), stops...), end)
+	}
+
+	var unreachable []int
+	for _, to := range targets {
+		sources := append([]int{0}, stops...)
+		if to == end && len(stops) > 0 {
+			sources = stops
+		}
+		reachable := false
+		for _, from := range sources {
+			if from != to && legs[from][to].Unreachable == "" {
+				reachable = true
+				break
+			}
+		}
+		if !reachable {
+			unreachable = append(unreachable, to)
+		}
+	}
+	return unreachable
+}
+
+// unreachableLegs returns the legs of the route 0 -> order... -> end that
+// no product can be booked for.
+func unreachableLegs(legs [][]legEstimate, order []int, end int) [][2]int {
+	rides := order
+	if end != openEnd {
+		rides = append(append([]int(nil), order...), end)
+	}
+	var unreachable [][2]int
+	from := 0
+	for _, to := range rides {
+		if legs[from][to].Unreachable != "" {
+			unreachable = append(unreachable, [2]int{from, to})
+		}
+		from = to
+	}
+	return unreachable
+}
+
+// routeStops returns the points of legs to visit between point 0 and end.
+func routeStops(legs [][]legEstimate, end int) []int {
+	stops := make([]int, 0, len(legs))
+	for i := 1; i < len(legs); i++ {
+		if i != end {
+			stops = append(stops, i)
+		}
+	}
+	return stops
+}
+
+// finish is the cost of the ride from the last stop to end.
+func finish(legs [][]legEstimate, from, end int) pathCost {
+	if end == openEnd {
+		return pathCost{}
+	}
+	return pathCost{score: legs[from][end].Score, duration: legs[from][end].Duration}
+}
+
+// heldKarp returns the provably lowest scoring route through all stops
+// using dynamic programming over subsets of stops. Ties go to the shorter
+// total duration.
+func heldKarp(legs [][]legEstimate, end int) []int {
+	stops := routeStops(legs, end)
+	n := len(stops)
+	if n == 0 {
+		return []int{}
+	}
+
+	// best[mask][j] is the lowest scoring path that starts at point 0, visits
+	// exactly the stops in mask and ends at stops[j].
+	full := 1<<uint(n) - 1
+	best := make([][]pathCost, full+1)
+	for mask := range best {
+		best[mask] = make([]pathCost, n)
+		for j := range best[mask] {
+			best[mask][j] = pathCost{score: math.Inf(1), duration: math.Inf(1), prev: -1}
+		}
+	}
+	for j := 0; j < n; j++ {
+		leg := legs[0][stops[j]]
+		best[1<<uint(j)][j] = pathCost{score: leg.Score, duration: leg.Duration, prev: -1}
+	}
+
+	for mask := 1; mask <= full; mask++ {
+		for j := 0; j < n; j++ {
+			cur := best[mask][j]
+			if mask&(1<<uint(j)) == 0 || math.IsInf(cur.score, 1) {
+				continue
+			}
+			for k := 0; k < n; k++ {
+				if mask&(1<<uint(k)) != 0 {
+					continue
+				}
+				leg := legs[stops[j]][stops[k]]
+				next := pathCost{score: cur.score + leg.Score, duration: cur.duration + leg.Duration, prev: j}
+				if next.less(best[mask|1<<uint(k)][k]) {
+					best[mask|1<<uint(k)][k] = next
+				}
+			}
+		}
+	}
+
+	// Close the route at its end.
+	last := -1
+	var total pathCost
+	for j := 0; j < n; j++ {
+		f := finish(legs, stops[j], end)
+		done := pathCost{score: best[full][j].score + f.score, duration: best[full][j].duration + f.duration}
+		if last == -1 || done.less(total) {
+			last = j
+			total = done
+		}
+	}
+	// Without any route avoiding unreachable legs there is no path to
+	// rebuild; any order will do as the caller rejects it.
+	if math.IsInf(total.score, 1) {
+		return nearestNeighbour(legs, end)
+	}
+
+	order := make([]int, n)
+	mask := full
+	for i := n - 1; i >= 0; i-- {
+		order[i] = stops[last]
+		prev := best[mask][last].prev
+		mask &^= 1 << uint(last)
+		last = prev
+	}
+	return order
+}
+
+// pathCost is the running total of a partial route in heldKarp.
+type pathCost struct {
+	score, duration float64
+	// prev is the stop visited before the last one, or -1.
+	prev int
+}
+
+// less reports whether a beats b on score, then on duration.
+func (a pathCost) less(b pathCost) bool {
+	return a.score < b.score || (a.score == b.score && a.duration < b.duration)
+}
+
+// nearestNeighbour builds a route by always riding to the lowest scoring
+// unvisited stop next, preferring the shorter ride on equal score.
+func nearestNeighbour(legs [][]legEstimate, end int) []int {
+	stops := routeStops(legs, end)
+	visited := make([]bool, len(legs))
+	order := make([]int, 0, len(stops))
+
+	cur := 0
+	for len(order) < len(stops) {
+		next := -1
+		for _, j := range stops {
+			if visited[j] {
+				continue
+			}
+			if next == -1 || legs[cur][j].Score < legs[cur][next].Score ||
+				(legs[cur][j].Score == legs[cur][next].Score && legs[cur][j].Duration < legs[cur][next].Duration) {
+				next = j
+			}
+		}
+		visited[next] = true
+		order = append(order, next)
+		cur = next
+	}
+	return order
+}
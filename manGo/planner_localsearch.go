@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+)
+
+const algorithmLocalSearch = "greedy+2-opt+or-opt"
+
+// Defaults for the local search budget when a trip request sets none.
+const (
+	defaultImprovementPasses = 50
+	defaultImprovementTime   = 2 * time.Second
+)
+
+// improvementBudget bounds the local search run on heuristic routes.
+// Search stops after Passes full passes without reaching a local optimum
+// or once Time has elapsed, whichever comes first.
+type improvementBudget struct {
+	Passes int
+	Time   time.Duration
+}
+
+// improveRoute repeatedly applies improving 2-opt and Or-opt moves to order
+// until no move helps or the budget runs out. Routes are compared on total
+// score including the ride to end, then on total duration. A pass cut
+// short by the deadline still keeps the best move it found.
+func improveRoute(legs [][]legEstimate, order []int, end int, budget improvementBudget) []int {
+	route := append([]int(nil), order...)
+	best := routeCost(legs, route, end)
+	deadline := time.Now().Add(budget.Time)
+
+	for pass := 0; pass < budget.Passes && time.Now().Before(deadline); pass++ {
+		improved := false
+		if candidate, c, ok := twoOpt(legs, route, end, best, deadline); ok {
+			route, best, improved = candidate, c, true
+		}
+		if candidate, c, ok := orOpt(legs, route, end, best, deadline); ok {
+			route, best, improved = candidate, c, true
+		}
+		if !improved {
+			break
+		}
+	}
+	return route
+}
+
+// twoOpt tries reversing every segment of route, until deadline, and
+// keeps the best result if it beats current.
+func twoOpt(legs [][]legEstimate, route []int, end int, current pathCost, deadline time.Time) ([]int, pathCost, bool) {
+	var bestRoute []int
+	best := current
+	candidate := make([]int, len(route))
+	for i := 0; i < len(route)-1 && time.Now().Before(deadline); i++ {
+		for k := i + 1; k < len(route); k++ {
+			copy(candidate, route)
+			for a, b := i, k; a < b; a, b = a+1, b-1 {
+				candidate[a], candidate[b] = candidate[b], candidate[a]
+			}
+			if c := routeCost(legs, candidate, end); c.less(best) {
+				best = c
+				bestRoute = append(bestRoute[:0], candidate...)
+			}
+		}
+	}
+	return bestRoute, best, bestRoute != nil
+}
+
+// orOpt tries moving every run of one to three consecutive stops to every
+// other position in route, until deadline, and keeps the best result if it
+// beats current.
+func orOpt(legs [][]legEstimate, route []int, end int, current pathCost, deadline time.Time) ([]int, pathCost, bool) {
+	var bestRoute []int
+	best := current
+	candidate := make([]int, 0, len(route))
+	for size := 1; size <= 3 && size < len(route); size++ {
+		for i := 0; i+size <= len(route) && time.Now().Before(deadline); i++ {
+			segment := route[i : i+size]
+			rest := append(append([]int(nil), route[:i]...), route[i+size:]...)
+			for pos := 0; pos <= len(rest); pos++ {
+				if pos == i {
+					continue
+				}
+				candidate = append(candidate[:0], rest[:pos]...)
+				candidate = append(candidate, segment...)
+				candidate = append(candidate, rest[pos:]...)
+				if c := routeCost(legs, candidate, end); c.less(best) {
+					best = c
+					bestRoute = append(bestRoute[:0], candidate...)
+				}
+			}
+		}
+	}
+	return bestRoute, best, bestRoute != nil
+}
+
+// routeCost totals the legs of the route 0 -> order... -> end.
+func routeCost(legs [][]legEstimate, order []int, end int) pathCost {
+	var total pathCost
+	from := 0
+	for _, to := range order {
+		total.score += legs[from][to].Score
+		total.duration += legs[from][to].Duration
+		from = to
+	}
+	f := finish(legs, from, end)
+	total.score += f.score
+	total.duration += f.duration
+	return total
+}
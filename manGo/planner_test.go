@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// randomLegs returns a matrix of n points with random scores and
+// durations. Each leg is unreachable with probability unreachable.
+func randomLegs(rng *rand.Rand, n int, unreachable float64) [][]legEstimate {
+	legs := make([][]legEstimate, n)
+	for i := range legs {
+		legs[i] = make([]legEstimate, n)
+		for j := range legs[i] {
+			switch {
+			case i == j:
+			case rng.Float64() < unreachable:
+				legs[i][j] = unreachableLeg(reasonNoProducts, nil)
+			default:
+				// Few distinct scores so that ties on score are common
+				score := float64(rng.Intn(20))
+				legs[i][j] = legEstimate{Cost: score, Score: score, Duration: float64(rng.Intn(600))}
+			}
+		}
+	}
+	return legs
+}
+
+// bruteForce returns the lowest cost of any route through the stops.
+func bruteForce(legs [][]legEstimate, end int) pathCost {
+	stops := routeStops(legs, end)
+	best := pathCost{score: math.Inf(1), duration: math.Inf(1)}
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(stops) {
+			if c := routeCost(legs, stops, end); c.less(best) {
+				best = c
+			}
+			return
+		}
+		for i := k; i < len(stops); i++ {
+			stops[k], stops[i] = stops[i], stops[k]
+			permute(k + 1)
+			stops[k], stops[i] = stops[i], stops[k]
+		}
+	}
+	permute(0)
+	return best
+}
+
+func sameCost(a, b float64) bool {
+	return a == b || math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestHeldKarpMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(273))
+	for _, tc := range []struct {
+		name        string
+		points      int
+		end         func(n int) int
+		unreachable float64
+	}{
+		{"round trip", 7, func(n int) int { return 0 }, 0},
+		{"fixed end", 7, func(n int) int { return n - 1 }, 0},
+		{"open end", 7, func(n int) int { return openEnd }, 0},
+		{"round trip with unreachable legs", 6, func(n int) int { return 0 }, 0.3},
+		{"fixed end with unreachable legs", 6, func(n int) int { return 1 + rng.Intn(n-1) }, 0.3},
+		{"open end with unreachable legs", 6, func(n int) int { return openEnd }, 0.3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				n := 2 + rng.Intn(tc.points-1)
+				legs := randomLegs(rng, n, tc.unreachable)
+				end := tc.end(n)
+
+				order := heldKarp(legs, end)
+				if missing, repeated := checkRoute(legs, order, end); len(missing) > 0 || len(repeated) > 0 {
+					t.Fatalf("case %d: route %v misses %v and repeats %v", i, order, missing, repeated)
+				}
+				got, want := routeCost(legs, order, end), bruteForce(legs, end)
+				if !sameCost(got.score, want.score) || (!math.IsInf(want.score, 1) && !sameCost(got.duration, want.duration)) {
+					t.Fatalf("case %d, end %d: route %v costs %v/%v, brute force finds %v/%v\n%v",
+						i, end, order, got.score, got.duration, want.score, want.duration, legs)
+				}
+			}
+		})
+	}
+}
+
+func TestImproveRouteNeverWorse(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	budget := improvementBudget{Passes: defaultImprovementPasses, Time: time.Second}
+	for _, tc := range []struct {
+		name        string
+		end         func(n int) int
+		unreachable float64
+	}{
+		{"round trip", func(n int) int { return 0 }, 0},
+		{"fixed end", func(n int) int { return n - 1 }, 0},
+		{"open end", func(n int) int { return openEnd }, 0},
+		{"round trip with unreachable legs", func(n int) int { return 0 }, 0.2},
+		{"fixed end with unreachable legs", func(n int) int { return 1 + rng.Intn(n-1) }, 0.2},
+		{"open end with unreachable legs", func(n int) int { return openEnd }, 0.2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				n := 2 + rng.Intn(19)
+				legs := randomLegs(rng, n, tc.unreachable)
+				end := tc.end(n)
+
+				greedy := nearestNeighbour(legs, end)
+				order := improveRoute(legs, greedy, end, budget)
+				if missing, repeated := checkRoute(legs, order, end); len(missing) > 0 || len(repeated) > 0 {
+					t.Fatalf("case %d: route %v misses %v and repeats %v", i, order, missing, repeated)
+				}
+				if got, was := routeCost(legs, order, end), routeCost(legs, greedy, end); was.less(got) {
+					t.Fatalf("case %d, end %d: route %v costs %v/%v, greedy route %v only %v/%v",
+						i, end, order, got.score, got.duration, greedy, was.score, was.duration)
+				}
+			}
+		})
+	}
+}
+
+func TestImproveRouteDeadline(t *testing.T) {
+	// A single pass over this many stops takes far longer than the budget
+	legs := randomLegs(rand.New(rand.NewSource(50)), 300, 0)
+	greedy := nearestNeighbour(legs, 0)
+	start := time.Now()
+	order := improveRoute(legs, greedy, 0, improvementBudget{Passes: defaultImprovementPasses, Time: 10 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("local search took %v with a budget of 10ms", elapsed)
+	}
+	if missing, repeated := checkRoute(legs, order, 0); len(missing) > 0 || len(repeated) > 0 {
+		t.Fatalf("route misses %v and repeats %v", missing, repeated)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// RideRequest is the part of the POST /v1/requests and
+// GET /v1/requests/:request_id responses we use.
+type RideRequest struct {
+	Request_id string  `json:"request_id"`
+	Status     string  `json:"status"`
+	Eta        float64 `json:"eta"`
+}
+
+// uberRides requests rides through the Uber API on behalf of the user
+// owning accessToken.
+type uberRides struct {
+	baseURL     string
+	accessToken string
+	client      *upstreamClient
+}
+
+var rideClient *uberRides
+
+func newUberRides(baseURL, accessToken string, client *upstreamClient) *uberRides {
+	return &uberRides{baseURL: baseURL, accessToken: accessToken, client: client}
+}
+
+// Request books a ride with the given product between two coordinates.
+func (u *uberRides) Request(ctx context.Context, ride PostRequestBody) (RideRequest, error) {
+	var result RideRequest
+	resp, err := u.do(ctx, "POST", "/v1/requests", ride)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return result, uberStatusError("uber ride request", resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("uber ride request: %v", err)
+	}
+	if result.Request_id == "" {
+		return result, fmt.Errorf("uber ride request: no request_id in response")
+	}
+	return result, nil
+}
+
+// Status looks up a ride booked earlier.
+func (u *uberRides) Status(ctx context.Context, requestId string) (RideRequest, error) {
+	var result RideRequest
+	resp, err := u.do(ctx, "GET", "/v1/requests/"+requestId, nil)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, uberStatusError("uber ride status", resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("uber ride status: %v", err)
+	}
+	return result, nil
+}
+
+// Complete moves a sandbox ride straight to the completed state.
+func (u *uberRides) Complete(ctx context.Context, requestId string) error {
+	resp, err := u.do(ctx, "PUT", "/v1/sandbox/requests/"+requestId, PutRequestBody{Status: "completed"})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return uberStatusError("uber sandbox ride update", resp)
+	}
+	return nil
+}
+
+// Cancel cancels a ride that has not been completed yet.
+func (u *uberRides) Cancel(ctx context.Context, requestId string) error {
+	resp, err := u.do(ctx, "DELETE", "/v1/requests/"+requestId, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return uberStatusError("uber ride cancel", resp)
+	}
+	return nil
+}
+
+func (u *uberRides) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+u.accessToken)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return u.client.Do(request)
+}
+
+// uberStatusError describes an unexpected response from the Uber API,
+// including the code and message of its error body when there is one.
+func uberStatusError(call string, resp *http.Response) error {
+	var body struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) != nil || body.Message == "" {
+		return fmt.Errorf("%s: %s", call, resp.Status)
+	}
+	return fmt.Errorf("%s: %s: %s (%s)", call, resp.Status, body.Message, body.Code)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adhocStopPrefix starts the ids given to ad-hoc stops, which can never
+// clash with the numeric ids of stored locations.
+const adhocStopPrefix = "adhoc-"
+
+// TripStop is a stop given inline in a trip request: the id of a stored
+// location, a coordinate, or an address that is geocoded for this trip
+// only. Exactly one of them must be set.
+type TripStop struct {
+	Location_id string
+	Lat         *float64
+	Lng         *float64
+	Address     string
+}
+
+// AdhocStop is a stop of a trip that is not a stored location. Its Id
+// stands in for a location id in the route and legs of the trip.
+type AdhocStop struct {
+	Id         string
+	Address    string
+	Coordinate LocationLatLng
+}
+
+// resolveStop returns the id and coordinates of stop. Coordinates and
+// addresses are added to trip.Adhoc_stops, nothing is persisted.
+func resolveStop(ctx context.Context, trip *Trip, stop TripStop) (string, LocationLatLng, error) {
+	set := 0
+	for _, given := range []bool{stop.Location_id != "", stop.Address != "", stop.Lat != nil || stop.Lng != nil} {
+		if given {
+			set++
+		}
+	}
+	if set != 1 {
+		return "", LocationLatLng{}, newAPIError(http.StatusBadRequest, "invalid_stop", "A stop needs exactly one of location_id, address or lat and lng.", map[string]interface{}{"stop": stop})
+	}
+
+	if stop.Location_id != "" {
+		coordinate, err := lookupLocation(stop.Location_id)
+		return stop.Location_id, coordinate, err
+	}
+
+	adhoc := AdhocStop{
+		Id:      adhocStopPrefix + strconv.Itoa(len(trip.Adhoc_stops)+1),
+		Address: stop.Address,
+	}
+	if stop.Address != "" {
+		coordinate, err := geocoder.Geocode(ctx, stop.Address)
+		if err != nil {
+			return "", LocationLatLng{}, geocodeError(err, stop.Address)
+		}
+		adhoc.Coordinate = coordinate
+	} else {
+		if stop.Lat == nil || stop.Lng == nil {
+			return "", LocationLatLng{}, newAPIError(http.StatusBadRequest, "invalid_stop", "A stop needs both lat and lng.", map[string]interface{}{"stop": stop})
+		}
+		if *stop.Lat < -90 || *stop.Lat > 90 || *stop.Lng < -180 || *stop.Lng > 180 {
+			return "", LocationLatLng{}, newAPIError(http.StatusBadRequest, "invalid_stop", "lat must be within [-90, 90] and lng within [-180, 180].", map[string]interface{}{"stop": stop})
+		}
+		adhoc.Coordinate = LocationLatLng{Lat: *stop.Lat, Lng: *stop.Lng}
+	}
+	trip.Adhoc_stops = append(trip.Adhoc_stops, adhoc)
+	return adhoc.Id, adhoc.Coordinate, nil
+}
+
+// lookupLocation returns the coordinates of the stored location id.
+func lookupLocation(id string) (LocationLatLng, error) {
+	location_id, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return LocationLatLng{}, newAPIError(http.StatusBadRequest, "invalid_id", "location ids must be integers.", map[string]interface{}{"location_id": id})
+	}
+
+	locResp, err := locationStore.GetLocation(location_id)
+	if err != nil {
+		return LocationLatLng{}, storeError(err, "location", id)
+	}
+	return locResp.Coordinate, nil
+}
+
+// coordinate returns the coordinates of a location or ad-hoc stop of the
+// trip.
+func (t *Trip) coordinate(id string) (LocationLatLng, error) {
+	if strings.HasPrefix(id, adhocStopPrefix) {
+		for _, stop := range t.Adhoc_stops {
+			if stop.Id == id {
+				return stop.Coordinate, nil
+			}
+		}
+		return LocationLatLng{}, newAPIError(http.StatusNotFound, "location_not_found", "No such location found.", map[string]interface{}{"location_id": id})
+	}
+	return lookupLocation(id)
+}
+
+// stopLocationIds maps stop indexes of a trip to their location ids.
+func stopLocationIds(locationIds []string, stops []int) []string {
+	ids := make([]string, 0, len(stops))
+	for _, stop := range stops {
+		if stop >= 0 && stop < len(locationIds) {
+			ids = append(ids, locationIds[stop])
+		} else {
+			ids = append(ids, strconv.Itoa(stop))
+		}
+	}
+	return ids
+}
+
+// unreachableDetails describes stops that no ride to can be booked, with
+// the reason recorded for the ride from the start, or from the first stop
+// for the end of a round trip or a fixed ending location.
+func unreachableDetails(locationIds []string, legs [][]legEstimate, stops []int, end int) []map[string]interface{} {
+	details := make([]map[string]interface{}, 0, len(stops))
+	for _, stop := range stops {
+		from := 0
+		if stop == end {
+			if others := routeStops(legs, end); len(others) > 0 {
+				from = others[0]
+			}
+		}
+		leg := legs[from][stop]
+		details = append(details, map[string]interface{}{
+			"location_id":       locationIds[stop],
+			"reason":            leg.Unreachable,
+			"unpriced_products": leg.Unpriced,
+		})
+	}
+	return details
+}
+
+// legDetails describes rides between stops that no product can be booked
+// for.
+func legDetails(locationIds []string, legs [][]legEstimate, pairs [][2]int) []map[string]interface{} {
+	details := make([]map[string]interface{}, 0, len(pairs))
+	for _, pair := range pairs {
+		leg := legs[pair[0]][pair[1]]
+		details = append(details, map[string]interface{}{
+			"from_location_id":  locationIds[pair[0]],
+			"to_location_id":    locationIds[pair[1]],
+			"reason":            leg.Unreachable,
+			"unpriced_products": leg.Unpriced,
+		})
+	}
+	return details
+}
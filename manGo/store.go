@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned by the stores when no document matches the given id.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned by the stores when a document would share a
+// unique key, such as its id, with an existing one.
+var ErrDuplicate = errors.New("duplicate key")
+
+// ErrConflict is returned by SaveTrip when the stored trip was changed by
+// another request since it was read.
+var ErrConflict = errors.New("trip changed concurrently")
+
+// LocationStore persists the locations created through the /locations routes.
+type LocationStore interface {
+	// CreateLocation assigns the next free Id to loc and stores it. Ids are
+	// allocated atomically, so concurrent creations never share one.
+	CreateLocation(loc *LocationResponse) error
+	GetLocation(id int64) (LocationResponse, error)
+	// UpdateLocation overwrites the address fields and coordinates of the
+	// location with loc.Id.
+	UpdateLocation(loc LocationResponse) error
+	RemoveLocation(id int64) error
+}
+
+// TripStore persists planned trips together with the progress made on
+// them through PUT /trips/:trip_id/request.
+type TripStore interface {
+	// CreateTrip assigns the next free Id to trip and stores it. Ids are
+	// allocated atomically, so concurrent creations never share one.
+	CreateTrip(trip *Trip) error
+	GetTrip(id int64) (Trip, error)
+	// SaveTrip replaces the stored trip with trip.Id if it still has
+	// prevStatus, the status it was read with, and returns ErrConflict
+	// otherwise. Every change of status goes through SaveTrip, so two
+	// requests racing on the same trip cannot both succeed.
+	SaveTrip(trip Trip, prevStatus string) error
+}
+
+// Seed values for the first location and trip ids.
+const (
+	firstLocationId = 12345
+	firstTripId     = 1122
+)
+
+var (
+	locationStore LocationStore
+	tripStore     TripStore
+)
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+)
+
+// memoryStore implements LocationStore and TripStore in process memory.
+// Nothing survives a restart; it is meant for local runs and tests.
+type memoryStore struct {
+	mu        sync.Mutex
+	locations map[int64]LocationResponse
+	trips     map[int64]Trip
+	// counters holds the last id handed out per collection, like the
+	// Counters collection of the mongo store.
+	counters map[string]int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		locations: make(map[int64]LocationResponse),
+		trips:     make(map[int64]Trip),
+		counters:  make(map[string]int64),
+	}
+}
+
+// nextId allocates the next id for collection, starting at seed. The
+// caller must hold s.mu.
+func (s *memoryStore) nextId(collection string, seed int64) int64 {
+	id, ok := s.counters[collection]
+	if !ok {
+		id = seed - 1
+	}
+	id++
+	s.counters[collection] = id
+	return id
+}
+
+func (s *memoryStore) CreateLocation(loc *LocationResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc.Id = s.nextId("locations", firstLocationId)
+	s.locations[loc.Id] = *loc
+	return nil
+}
+
+func (s *memoryStore) GetLocation(id int64) (LocationResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loc, ok := s.locations[id]
+	if !ok {
+		return LocationResponse{}, ErrNotFound
+	}
+	return loc, nil
+}
+
+func (s *memoryStore) UpdateLocation(loc LocationResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.locations[loc.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Address = loc.Address
+	stored.City = loc.City
+	stored.State = loc.State
+	stored.Zip = loc.Zip
+	stored.Coordinate = loc.Coordinate
+	s.locations[loc.Id] = stored
+	return nil
+}
+
+func (s *memoryStore) RemoveLocation(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.locations[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.locations, id)
+	return nil
+}
+
+func (s *memoryStore) CreateTrip(trip *Trip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trip.Id = s.nextId("trips", firstTripId)
+	s.trips[trip.Id] = copyTrip(*trip)
+	return nil
+}
+
+func (s *memoryStore) GetTrip(id int64) (Trip, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trip, ok := s.trips[id]
+	if !ok {
+		return Trip{}, ErrNotFound
+	}
+	return copyTrip(trip), nil
+}
+
+func (s *memoryStore) SaveTrip(trip Trip, prevStatus string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.trips[trip.Id]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Status != prevStatus {
+		return ErrConflict
+	}
+	s.trips[trip.Id] = copyTrip(trip)
+	return nil
+}
+
+// copyTrip returns trip with its slices detached from the stored copy.
+func copyTrip(trip Trip) Trip {
+	trip.Best_route_location_ids = append([]string{}, trip.Best_route_location_ids...)
+	trip.Status_history = append([]StatusChange(nil), trip.Status_history...)
+	trip.Legs = append([]TripLeg(nil), trip.Legs...)
+	trip.Adhoc_stops = append([]AdhocStop(nil), trip.Adhoc_stops...)
+	return trip
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// legacyTripProgress is a document of PutTripCollection, where the
+// progress of a trip was kept apart from its plan in TripsCollection.
+type legacyTripProgress struct {
+	Id                           int64
+	Status                       string
+	Next_destination_location_id string
+	Uber_wait_time_eta           float64
+	Completed_legs               int
+	Uber_request_id              string
+	Status_history               []StatusChange
+}
+
+// migrateTripProgress merges every PutTripCollection document into its
+// trip in TripsCollection and removes it. Each document is removed right
+// after its trip is saved, so an interrupted migration resumes on the next
+// start and a finished one is a no-op.
+func (s *mongoStore) migrateTripProgress() error {
+	var progress []legacyTripProgress
+	err := s.do("PutTripCollection", func(c *mgo.Collection) error {
+		return c.Find(nil).All(&progress)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range progress {
+		trip, err := s.GetTrip(p.Id)
+		if err == ErrNotFound {
+			log.Printf("migrate: dropping progress of unknown trip %d", p.Id)
+		} else if err != nil {
+			return err
+		} else {
+			prevStatus := trip.Status
+			p.mergeInto(&trip, time.Now())
+			if err := s.SaveTrip(trip, prevStatus); err != nil {
+				return err
+			}
+		}
+
+		err = s.do("PutTripCollection", func(c *mgo.Collection) error {
+			return c.Remove(bson.M{"id": p.Id})
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	if len(progress) > 0 {
+		log.Printf("migrate: merged %d PutTripCollection documents into TripsCollection", len(progress))
+	}
+	return nil
+}
+
+// mergeInto copies the progress onto trip.
+func (p legacyTripProgress) mergeInto(trip *Trip, at time.Time) {
+	trip.Status = p.Status
+	trip.Next_destination_location_id = p.Next_destination_location_id
+	trip.Uber_wait_time_eta = p.Uber_wait_time_eta
+	trip.Completed_legs = p.Completed_legs
+	trip.Uber_request_id = p.Uber_request_id
+	if p.Status_history != nil {
+		trip.Status_history = p.Status_history
+		return
+	}
+
+	// Written before trips had a state machine: "requesting" meant the
+	// sandbox ride to Next_destination_location_id was done, "reached"
+	// that the ride back to the start was.
+	trip.Status = statusCompleted
+	trip.Completed_legs = len(trip.Best_route_location_ids) + 1
+	if p.Status == "requesting" {
+		for i, id := range trip.Best_route_location_ids {
+			if id == p.Next_destination_location_id {
+				trip.Status = statusArrivedAtStop
+				trip.Completed_legs = i + 1
+				break
+			}
+		}
+	}
+	trip.Status_history = append(trip.Status_history, StatusChange{Status: trip.Status, At: at})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoStore implements LocationStore and TripStore on top of MongoDB.
+// It holds one long-lived root session; every operation works on a copy of
+// it, which reuses pooled sockets and reconnects transparently.
+type mongoStore struct {
+	root     *mgo.Session
+	database string
+}
+
+// newMongoStore dials the root session. It is called once at startup.
+func newMongoStore(cfg MongoConfig) (*mongoStore, error) {
+	info := &mgo.DialInfo{
+		Addrs:     cfg.Hosts,
+		Timeout:   60 * time.Second,
+		Database:  cfg.Database,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		PoolLimit: cfg.PoolLimit,
+		FailFast:  cfg.FailFast,
+	}
+	root, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional. Switch the session to a monotonic behavior.
+	root.SetMode(mgo.Monotonic, true)
+	if cfg.SyncTimeout.Duration > 0 {
+		root.SetSyncTimeout(cfg.SyncTimeout.Duration)
+	}
+	if cfg.SocketTimeout.Duration > 0 {
+		root.SetSocketTimeout(cfg.SocketTimeout.Duration)
+	}
+	s := &mongoStore{root: root, database: cfg.Database}
+	if err := s.ensureIndexes(); err != nil {
+		root.Close()
+		return nil, err
+	}
+	if err := s.migrateTripProgress(); err != nil {
+		root.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// ensureIndexes makes the ids unique, so a duplicate can never be stored
+// even if two writers race. Databases written by the old allocator may
+// already hold duplicates; those are reported so that the operator can
+// renumber them, since the index cannot be built until they are gone.
+func (s *mongoStore) ensureIndexes() error {
+	for _, name := range []string{"LocationCollection", "TripsCollection"} {
+		ids, err := s.duplicateIds(name)
+		if err != nil {
+			return fmt.Errorf("%s: looking for duplicate ids: %v", name, err)
+		}
+		if len(ids) > 0 {
+			return fmt.Errorf("%s: ids %v are used by more than one document; give each document a unique id before starting", name, ids)
+		}
+		err = s.do(name, func(c *mgo.Collection) error {
+			return c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true})
+		})
+		if err != nil {
+			return fmt.Errorf("%s: creating the unique index on id: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// duplicateIds returns up to 20 ids shared by several documents of
+// collection.
+func (s *mongoStore) duplicateIds(collection string) ([]int64, error) {
+	var groups []struct {
+		Id int64 `bson:"_id"`
+	}
+	err := s.do(collection, func(c *mgo.Collection) error {
+		return c.Pipe([]bson.M{
+			{"$group": bson.M{"_id": "$id", "count": bson.M{"$sum": 1}}},
+			{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+			{"$sort": bson.M{"_id": 1}},
+			{"$limit": 20},
+		}).All(&groups)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(groups))
+	for i, g := range groups {
+		ids[i] = g.Id
+	}
+	return ids, nil
+}
+
+// counter is a document in the Counters collection holding the last id
+// handed out for one collection.
+type counter struct {
+	Name string `bson:"_id"`
+	Seq  int64  `bson:"seq"`
+}
+
+// nextId atomically allocates the next id for collection using a
+// findAndModify on its counter. A missing counter is created from the
+// highest id already stored, or so that the first id is seed.
+func (s *mongoStore) nextId(collection string, seed int64) (int64, error) {
+	var c counter
+	err := s.do("Counters", func(counters *mgo.Collection) error {
+		_, err := counters.FindId(collection).Apply(mgo.Change{
+			Update:    bson.M{"$inc": bson.M{"seq": 1}},
+			ReturnNew: true,
+		}, &c)
+		return err
+	})
+	if err != ErrNotFound {
+		return c.Seq, err
+	}
+
+	// First allocation: start after any existing documents.
+	start := seed - 1
+	err = s.do(collection, func(docs *mgo.Collection) error {
+		var last struct {
+			Id int64 `bson:"id"`
+		}
+		err := docs.Find(nil).Sort("-id").One(&last)
+		if err == nil && last.Id > start {
+			start = last.Id
+		}
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = s.do("Counters", func(counters *mgo.Collection) error {
+		return counters.Insert(counter{Name: collection, Seq: start})
+	})
+	// Another request may have created the counter in the meantime.
+	if err != nil && err != ErrDuplicate {
+		return 0, err
+	}
+	return s.nextId(collection, seed)
+}
+
+// Close releases the root session and its socket pool.
+func (s *mongoStore) Close() {
+	s.root.Close()
+}
+
+// session returns a copy of the root session for a single store operation.
+// The caller must close it.
+func (s *mongoStore) session() *mgo.Session {
+	return s.root.Copy()
+}
+
+// do runs fn against the named collection using a copied session.
+func (s *mongoStore) do(name string, fn func(c *mgo.Collection) error) error {
+	session := s.session()
+	defer session.Close()
+
+	err := fn(session.DB(s.database).C(name))
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (s *mongoStore) CreateLocation(loc *LocationResponse) error {
+	id, err := s.nextId("LocationCollection", firstLocationId)
+	if err != nil {
+		return err
+	}
+	loc.Id = id
+	return s.do("LocationCollection", func(c *mgo.Collection) error {
+		return c.Insert(loc)
+	})
+}
+
+func (s *mongoStore) GetLocation(id int64) (LocationResponse, error) {
+	var locResp LocationResponse
+	err := s.do("LocationCollection", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"id": id}).One(&locResp)
+	})
+	return locResp, err
+}
+
+func (s *mongoStore) UpdateLocation(loc LocationResponse) error {
+	return s.do("LocationCollection", func(c *mgo.Collection) error {
+		return c.Update(bson.M{"id": loc.Id}, bson.M{"$set": bson.M{
+			"address":        loc.Address,
+			"city":           loc.City,
+			"state":          loc.State,
+			"zip":            loc.Zip,
+			"coordinate.lat": loc.Coordinate.Lat,
+			"coordinate.lng": loc.Coordinate.Lng}})
+	})
+}
+
+func (s *mongoStore) RemoveLocation(id int64) error {
+	return s.do("LocationCollection", func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"id": id})
+	})
+}
+
+func (s *mongoStore) CreateTrip(trip *Trip) error {
+	id, err := s.nextId("TripsCollection", firstTripId)
+	if err != nil {
+		return err
+	}
+	trip.Id = id
+	return s.do("TripsCollection", func(c *mgo.Collection) error {
+		return c.Insert(trip)
+	})
+}
+
+func (s *mongoStore) GetTrip(id int64) (Trip, error) {
+	var tripResp Trip
+	err := s.do("TripsCollection", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"id": id}).One(&tripResp)
+	})
+	return tripResp, err
+}
+
+func (s *mongoStore) SaveTrip(trip Trip, prevStatus string) error {
+	return s.do("TripsCollection", func(c *mgo.Collection) error {
+		err := c.Update(bson.M{"id": trip.Id, "status": prevStatus}, trip)
+		if err != mgo.ErrNotFound {
+			return err
+		}
+		// Tell a missing trip from one whose status has moved on
+		n, countErr := c.Find(bson.M{"id": trip.Id}).Count()
+		if countErr != nil {
+			return countErr
+		}
+		if n > 0 {
+			return ErrConflict
+		}
+		return err
+	})
+}
+
+// mongoEstimateCache is an EstimateCache persisted in MongoDB, so cached
+// estimates survive restarts and are shared between instances. Expired
+// documents are removed by a TTL index.
+type mongoEstimateCache struct {
+	store *mongoStore
+	ttl   time.Duration
+}
+
+type cachedEstimates struct {
+	Key        string            `bson:"_id"`
+	Estimates  []ProductEstimate `bson:"estimates"`
+	Expires_at time.Time         `bson:"expires_at"`
+}
+
+func newMongoEstimateCache(store *mongoStore, ttl time.Duration) (*mongoEstimateCache, error) {
+	err := store.do("EstimateCache", func(c *mgo.Collection) error {
+		return c.EnsureIndex(mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoEstimateCache{store: store, ttl: ttl}, nil
+}
+
+func (m *mongoEstimateCache) Get(key string) ([]ProductEstimate, bool) {
+	var doc cachedEstimates
+	err := m.store.do("EstimateCache", func(c *mgo.Collection) error {
+		return c.Find(bson.M{"_id": key, "expires_at": bson.M{"$gt": time.Now()}}).One(&doc)
+	})
+	if err != nil {
+		if err != ErrNotFound {
+			log.Println("estimate cache:", err)
+		}
+		return nil, false
+	}
+	return doc.Estimates, true
+}
+
+func (m *mongoEstimateCache) Set(key string, estimates []ProductEstimate) {
+	doc := cachedEstimates{Key: key, Estimates: estimates, Expires_at: time.Now().Add(m.ttl)}
+	err := m.store.do("EstimateCache", func(c *mgo.Collection) error {
+		_, err := c.UpsertId(key, doc)
+		return err
+	})
+	if err != nil {
+		log.Println("estimate cache:", err)
+	}
+}
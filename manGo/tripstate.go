@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Trip statuses.
+const (
+	// statusPlanning: the route is planned, no ride requested yet.
+	statusPlanning = "planning"
+	// statusRequesting: a ride to the next stop is being booked.
+	statusRequesting = "requesting"
+	// statusInProgress: the rider is on the way to the next stop.
+	statusInProgress = "in_progress"
+	// statusArrivedAtStop: the rider reached a stop and waits for the
+	// next ride.
+	statusArrivedAtStop = "arrived_at_stop"
+	// statusReturning: the rider is on the way back to the start, or on
+	// to the ending location of a one-way trip.
+	statusReturning = "returning"
+	// statusCompleted: the rider reached the end of the trip.
+	statusCompleted = "completed"
+	// statusCancelled: the trip was abandoned.
+	statusCancelled = "cancelled"
+	// statusFailed: booking or completing the last ride failed; the same
+	// ride can be requested again.
+	statusFailed = "failed"
+)
+
+// tripTransitions lists the statuses a trip may move to from each status.
+// A one-way trip without stops rides from planning straight to its ending
+// location, and one without an ending location is completed by its last
+// ride.
+var tripTransitions = map[string][]string{
+	statusPlanning:      {statusRequesting, statusReturning, statusCancelled},
+	statusRequesting:    {statusInProgress, statusFailed, statusCancelled},
+	statusInProgress:    {statusArrivedAtStop, statusCompleted, statusFailed, statusCancelled},
+	statusArrivedAtStop: {statusRequesting, statusReturning, statusCancelled},
+	statusReturning:     {statusCompleted, statusFailed, statusCancelled},
+	statusFailed:        {statusRequesting, statusReturning, statusCancelled},
+	statusCompleted:     {},
+	statusCancelled:     {},
+}
+
+// StatusChange records when a trip entered a status.
+type StatusChange struct {
+	Status string
+	At     time.Time
+}
+
+// TransitionError is returned for a status change the state machine does
+// not allow.
+type TransitionError struct {
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("trip cannot move from %s to %s", e.From, e.To)
+}
+
+// canTransition reports whether a trip in status from may move to to.
+func canTransition(from, to string) bool {
+	for _, allowed := range tripTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the trip to status to and records the time, or returns
+// a *TransitionError leaving the trip unchanged.
+func (t *Trip) transition(to string, at time.Time) error {
+	if !canTransition(t.Status, to) {
+		return &TransitionError{From: t.Status, To: to}
+	}
+	t.Status = to
+	t.Status_history = append(t.Status_history, StatusChange{Status: to, At: at})
+	return nil
+}
+
+// finalDestination returns the location the trip ends at after its last
+// stop: the start of a round trip or the ending location of a one-way
+// trip. ok is false for one-way trips that end at their last stop.
+func (t *Trip) finalDestination() (id string, ok bool) {
+	if !t.One_way {
+		return t.Starting_from_location_id, true
+	}
+	return t.Ending_location_id, t.Ending_location_id != ""
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling the upstream service while
+// its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// upstreamClient makes the HTTP calls to one upstream service, Uber or
+// Google. Every attempt is limited to cfg.Timeout. Failed attempts are
+// retried with exponential backoff and jitter, waiting at least as long
+// as a Retry-After header asks. After cfg.BreakerThreshold failed calls
+// in a row the circuit breaker opens and calls fail fast with
+// ErrCircuitOpen until cfg.BreakerCooldown has passed.
+//
+// Timeouts, connection errors and 5xx responses are retried for
+// idempotent methods only, so that a POST that may have booked a ride is
+// never sent twice. 429 responses are retried for every method.
+type upstreamClient struct {
+	service string
+	cfg     UpstreamConfig
+	client  *http.Client
+	breaker *circuitBreaker
+	// failedBody, if set, reports whether a 200 response still means the
+	// service is in trouble, for APIs such as Google's that report rate
+	// limits and server errors in the body. Such responses are retried
+	// and counted like 5xx ones.
+	failedBody func(body []byte) bool
+}
+
+func newUpstreamClient(service string, cfg UpstreamConfig) *upstreamClient {
+	return &upstreamClient{
+		service: service,
+		cfg:     cfg,
+		client:  &http.Client{},
+		breaker: newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown.Duration),
+	}
+}
+
+// Do sends req, retrying as configured. Like http.Client.Do it returns a
+// response for every HTTP status; the caller closes its body. Requests
+// with a body must be built with http.NewRequest or
+// http.NewRequestWithContext so that it can be sent again.
+func (c *upstreamClient) Do(req *http.Request) (*http.Response, error) {
+	if !c.breaker.allow() {
+		return nil, fmt.Errorf("%s: %w", c.service, ErrCircuitOpen)
+	}
+
+	resp, failed, err := c.retry(req)
+	if errors.Is(req.Context().Err(), context.Canceled) {
+		// The caller gave up; that says nothing about the service. A
+		// deadline of the caller's that expired is still counted, since
+		// the service was too slow to answer within it.
+		c.breaker.release()
+	} else {
+		c.breaker.record(err == nil && !failed)
+	}
+	return resp, err
+}
+
+// retry sends req until it succeeds or may not be retried any more.
+// failed reports whether the response returned means the service is in
+// trouble.
+func (c *upstreamClient) retry(req *http.Request) (resp *http.Response, failed bool, err error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, failed, err = c.attempt(req)
+		if attempt >= c.cfg.MaxAttempts || !retryable(req, resp, failed, err) {
+			return resp, failed, err
+		}
+
+		wait := c.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				// Retrying later than we are willing to wait is left to
+				// the client.
+				if after > c.cfg.MaxBackoff.Duration {
+					return resp, failed, err
+				}
+				if after > wait {
+					wait = after
+				}
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return resp, failed, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, false, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends req once within cfg.Timeout. The timeout also covers
+// reading the response body, which is read right away for failedBody.
+func (c *upstreamClient) attempt(req *http.Request) (*http.Response, bool, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.cfg.Timeout.Duration)
+	out := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, false, err
+		}
+		out.Body = body
+	}
+
+	resp, err := c.client.Do(out)
+	if err != nil {
+		cancel()
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK || c.failedBody == nil {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, failedStatus(resp.StatusCode), nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	cancel()
+	if err != nil {
+		return nil, false, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, c.failedBody(body), nil
+}
+
+// backoff is the wait before retry number attempt: cfg.Backoff doubled
+// for every earlier retry, capped at cfg.MaxBackoff, of which a random
+// half is dropped so that clients retrying together spread out.
+func (c *upstreamClient) backoff(attempt int) time.Duration {
+	wait := c.cfg.Backoff.Duration
+	for i := 1; i < attempt && wait < c.cfg.MaxBackoff.Duration; i++ {
+		wait *= 2
+	}
+	if wait > c.cfg.MaxBackoff.Duration {
+		wait = c.cfg.MaxBackoff.Duration
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryable reports whether a failed attempt may be sent again.
+func retryable(req *http.Request, resp *http.Response, failed bool, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return idempotent(req.Method)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return failed && idempotent(req.Method)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// failedStatus reports whether a response means the service is in
+// trouble, as opposed to rejecting the request itself.
+func failedStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := at.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// cancelOnClose releases the timeout of an attempt once its response
+// body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// circuitBreaker counts failed calls in a row. Once threshold is reached
+// it is open and refuses calls; after cooldown it lets a single trial
+// call through, which closes it again on success or reopens it on
+// failure. A threshold of zero disables the breaker.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// trial is set while the call let through after cooldown is running.
+	trial bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may be made now.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the outcome of a call allowed by allow.
+func (b *circuitBreaker) record(ok bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// release ends a call allowed by allow without counting it.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
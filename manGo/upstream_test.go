@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testUpstreamConfig() UpstreamConfig {
+	return UpstreamConfig{
+		Timeout:          Duration{time.Second},
+		MaxAttempts:      3,
+		Backoff:          Duration{time.Millisecond},
+		MaxBackoff:       Duration{50 * time.Millisecond},
+		BreakerThreshold: 2,
+		BreakerCooldown:  Duration{50 * time.Millisecond},
+	}
+}
+
+// upstreamServer answers with the statuses in order, repeating the last
+// one, and counts the calls it gets.
+func upstreamServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		for name, values := range header {
+			rw.Header()[name] = values
+		}
+		rw.WriteHeader(statuses[n-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		method    string
+		statuses  []int
+		want      int
+		wantCalls int32
+	}{
+		{"recovers", "GET", []int{503, 500, 200}, 200, 3},
+		{"gives up", "GET", []int{502}, 502, 3},
+		{"client error", "GET", []int{404}, 404, 1},
+		{"post not repeated", "POST", []int{500, 200}, 500, 1},
+		{"post rate limited", "POST", []int{429, 200}, 200, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, calls := upstreamServer(t, nil, tc.statuses...)
+			client := newUpstreamClient("Test", testUpstreamConfig())
+
+			req, _ := http.NewRequest(tc.method, server.URL, strings.NewReader("{}"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want || *calls != tc.wantCalls {
+				t.Fatalf("status %d after %d calls, want %d after %d", resp.StatusCode, *calls, tc.want, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetryAfter(t *testing.T) {
+	// Waits at least as long as asked
+	cfg := testUpstreamConfig()
+	cfg.MaxBackoff = Duration{2 * time.Second}
+	server, calls := upstreamServer(t, http.Header{"Retry-After": {"1"}}, 429, 200)
+	start := time.Now()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := newUpstreamClient("Test", cfg).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || *calls != 2 || time.Since(start) < time.Second {
+		t.Fatalf("status %d after %d calls and %v", resp.StatusCode, *calls, time.Since(start))
+	}
+
+	// Longer than max_backoff is not waited for
+	server, calls = upstreamServer(t, http.Header{"Retry-After": {"120"}}, 503, 200)
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	resp, err = newUpstreamClient("Test", testUpstreamConfig()).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 || *calls != 1 {
+		t.Fatalf("status %d after %d calls, want 503 after 1", resp.StatusCode, *calls)
+	}
+
+	now := time.Date(2016, 11, 20, 10, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"3":                             3 * time.Second,
+		"Sun, 20 Nov 2016 10:00:30 GMT": 30 * time.Second,
+		"Sun, 20 Nov 2016 09:00:00 GMT": 0,
+	} {
+		if got, ok := retryAfter(value, now); !ok || got != want {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v", value, got, ok, want)
+		}
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		if _, ok := retryAfter(value, now); ok {
+			t.Errorf("retryAfter(%q) accepted", value)
+		}
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	cfg := testUpstreamConfig()
+	cfg.Timeout = Duration{20 * time.Millisecond}
+	cfg.MaxAttempts = 2
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := newUpstreamClient("Test", cfg).Do(req)
+	if apiErr := upstreamError("Test", err); apiErr.Code != "upstream_timeout" || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("%v after %d calls, want a timeout after 2", err, calls)
+	}
+}
+
+func TestUpstreamCircuitBreakerStates(t *testing.T) {
+	server, calls := upstreamServer(t, nil, 500, 500, 200)
+	cfg := testUpstreamConfig()
+	cfg.MaxAttempts = 1
+	client := newUpstreamClient("Test", cfg)
+	get := func() (int, error) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// Two failures in a row open the breaker
+	for i := 0; i < 2; i++ {
+		if status, err := get(); status != 500 || err != nil {
+			t.Fatalf("call %d: %d, %v", i, status, err)
+		}
+	}
+	if _, err := get(); !errors.Is(err, ErrCircuitOpen) || *calls != 2 {
+		t.Fatalf("open breaker: %v after %d calls", err, *calls)
+	}
+	if apiErr := upstreamError("Test", ErrCircuitOpen); apiErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("open breaker reported as %d", apiErr.Status)
+	}
+
+	// After the cooldown the trial call succeeds and closes it
+	time.Sleep(cfg.BreakerCooldown.Duration)
+	for i := 0; i < 2; i++ {
+		if status, err := get(); status != 200 || err != nil {
+			t.Fatalf("after cooldown, call %d: %d, %v", i, status, err)
+		}
+	}
+}
+
+func TestUpstreamFailedBody(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			rw.Write([]byte("limited"))
+			return
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	client := newUpstreamClient("Test", testUpstreamConfig())
+	client.failedBody = func(body []byte) bool { return string(body) == "limited" }
+
+	// Retried like a 5xx, and the body of the answer is still readable
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("%q after %d calls, want \"ok\" after 2", body, calls)
+	}
+}
+
+func TestUpstreamCircuitBreakerDeadlines(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	client := newUpstreamClient("Test", testUpstreamConfig())
+	get := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Calls the caller cancels are not counted
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		if err := get(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("cancelled call %d: %v", i, err)
+		}
+	}
+
+	// Calls that run out of the caller's time before the attempt
+	// timeout are
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := get(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("call %d past its deadline: %v", i, err)
+		}
+	}
+	if err := get(context.Background()); !errors.Is(err, ErrCircuitOpen) || atomic.LoadInt32(&calls) != 5 {
+		t.Fatalf("open breaker: %v after %d calls", err, calls)
+	}
+}